@@ -1,7 +1,6 @@
 package arithmetic
 
 import (
-	"errors"
 	"false-vm/input"
 	"false-vm/vm"
 	"io"
@@ -14,90 +13,378 @@ func NewParser() *Parser {
 	return &Parser{}
 }
 
-type operator struct {
-	Weight int
-	Value  rune
+func init() {
+	input.Register(input.Language{
+		Name:       "arithmetic",
+		Aliases:    []string{"arith", "calc"},
+		Extensions: []string{".txt"},
+		New:        func() input.Parser { return NewParser() },
+	})
+}
+
+// priority Weight of binary operators, operators of the same weight are left associative
+var priority = map[string]int{
+	"<":  1,
+	">":  1,
+	"<=": 1,
+	">=": 1,
+	"==": 1,
+	"!=": 1,
+	"+":  2,
+	"-":  2,
+	"*":  3,
+	"/":  3,
+	"%":  3,
+}
+
+// compiler Statements compilation state, variables are memory cells placed after the program. Tokens are read on
+// demand with a single token lookahead, so code is written while the source is streamed
+type compiler struct {
+	ti *TokenInput
+	// ahead Token peeked but not taken yet
+	ahead  token
+	peeked bool
+	bc     *vm.BytecodeWriter
+	diags  *input.Diagnostics
+	vars   map[string]vm.Label
+	// names Variables in order of definition
+	names []string
 }
 
 func (p *Parser) Parse(r io.Reader, w io.Writer) error {
-	data, err := io.ReadAll(r)
-	if err != nil {
+	diags := input.NewDiagnostics(input.SourceName(r), "")
+	in := input.NewReaderInput(r, diags)
+	ti := TokenInput{Input: in}
+
+	c := &compiler{
+		ti:    &ti,
+		bc:    vm.NewBytecodeWriter(),
+		diags: diags,
+		vars:  make(map[string]vm.Label),
+	}
+	// Errors are reported to diags and compilation goes on to find all of them
+	if err := c.block(nil); err != nil {
+		return err
+	}
+	if err := in.Err(); err != nil {
+		return err
+	}
+	if err := diags.Err(); err != nil {
 		return err
 	}
-	ti := TokenInput{Input: &input.StringInput{Str: string(data)}}
+	c.bc.WriteEnd()
+	for _, name := range c.names {
+		c.bc.Bind(c.vars[name])
+		c.bc.AddSymbol(c.bc.Len(), name)
+		c.bc.WriteInt(0)
+	}
+	_, err := c.bc.WriteTo(w)
+	return err
+}
 
-	bc := vm.NewBytecodeWriter()
+func (c *compiler) peek() token {
+	if !c.peeked {
+		// Erroneous tokens are croaked by the token input and skipped
+		for {
+			t, err := c.ti.ReadToken()
+			if err == nil {
+				c.ahead = t
+				break
+			}
+		}
+		c.peeked = true
+	}
+	return c.ahead
+}
 
-	priority := make(map[rune]int)
-	priority[Open] = 0
-	priority[Plus] = 1
-	priority[Minus] = 1
-	priority[Multiply] = 2
-	priority[Divide] = 2
+func (c *compiler) next() token {
+	t := c.peek()
+	if t.kind != tokEOF {
+		c.peeked = false
+	}
+	return t
+}
 
-	s := vm.NewStack()
+// unread Return the token just taken by next, it is peeked again
+func (c *compiler) unread(t token) {
+	c.ahead, c.peeked = t, true
+}
 
-	for !ti.Eof() {
-		if ti.IsOperand() {
-			v, err := ti.ReadOperand()
-			if err != nil {
-				return err
-			}
-			bc.WritePush(v)
-		} else if ti.IsOperator() {
-			o := ti.ReadOperator()
-			rw, ok := priority[o]
-			if !ok {
-				return errors.New("unknown operator")
-			}
-			ro := operator{
-				Weight: rw,
-				Value:  o,
+func (c *compiler) errorf(t token, format string, args ...any) {
+	c.diags.Errorf(t.line, t.col, format, args...)
+}
+
+// skipLine Skip the rest of the erroneous line
+func (c *compiler) skipLine() {
+	for t := c.peek(); t.kind != tokNewline && t.kind != tokEOF; t = c.peek() {
+		c.next()
+	}
+}
+
+// endLine Check the statement ends with the line
+func (c *compiler) endLine() {
+	if t := c.peek(); t.kind != tokNewline && t.kind != tokEOF {
+		c.errorf(t, "unexpected %s at the end of statement", describe(t))
+		c.skipLine()
+	}
+}
+
+// block Compile statements up to the end keyword of the block opened by the token or up to the end of source
+func (c *compiler) block(open *token) error {
+	for {
+		t := c.peek()
+		switch {
+		case t.kind == tokEOF:
+			if open != nil {
+				c.errorf(*open, "%s block is not closed", open.text)
 			}
-			if s.Len() != 0 && s.Peek().(operator).Weight > rw {
-				for s.Peek().(operator).Weight > rw && s.Peek().(operator).Value != Open {
-					popOperatorStack(s, bc)
-				}
+			return nil
+		case t.kind == tokNewline:
+			c.next()
+		case t.kind == tokIdent && t.text == END:
+			c.next()
+			if open == nil {
+				c.errorf(t, "end without block")
+				c.skipLine()
+				continue
 			}
-			s.Push(ro)
-		} else if ti.IsCommaStat() {
-			ti.Skip()
-			s.Push(operator{
-				Weight: priority[Open],
-				Value:  Open,
-			})
-		} else if ti.IsCommaEnd() {
-			ti.Skip()
-			for s.Peek().(operator).Value != Open {
-				popOperatorStack(s, bc)
+			c.endLine()
+			return nil
+		default:
+			if err := c.statement(); err != nil {
+				return err
 			}
+		}
+	}
+}
+
+// statement Compile single statement, expression statement prints its value
+func (c *compiler) statement() error {
+	t := c.peek()
+	c.bc.SetSourcePos(t.line, t.col)
+	if t.kind != tokIdent {
+		c.print()
+		return nil
+	}
+	switch t.text {
+	case LET:
+		c.next()
+		name := c.next()
+		if name.kind != tokIdent || isKeyword(name.text) {
+			c.errorf(name, "variable name expected, found %s", describe(name))
+			c.skipLine()
+			return nil
+		}
+		if eq := c.next(); eq.kind != tokOperator || eq.text != string(Assign) {
+			c.errorf(eq, "= expected, found %s", describe(eq))
+			c.skipLine()
+			return nil
+		}
+		if !c.expression() {
+			return nil
+		}
+		c.bc.WriteStoreLabel(c.define(name.text))
+		c.endLine()
+	case PRINT:
+		c.next()
+		c.print()
+	case IF:
+		c.next()
+		if !c.expression() {
+			// Block is still parsed to pair its end with the statement, the code is discarded with the failed compilation
+			return c.block(&t)
+		}
+		c.endLine()
+		// Body sub is called by CallIf on true condition
+		c.bc.SubCreate()
+		if err := c.block(&t); err != nil {
+			return err
+		}
+		if err := c.bc.SubReturn(); err != nil {
+			return err
+		}
+		c.bc.WriteCallIf()
+	case WHILE:
+		c.next()
+		start, end := c.bc.NewLabel(), c.bc.NewLabel()
+		c.bc.Bind(start)
+		if !c.expression() {
+			return c.block(&t)
+		}
+		c.endLine()
+		// Exit by GotoIf on false condition
+		c.bc.WriteCommand(vm.InstrNot)
+		c.bc.WritePushLabel(end)
+		c.bc.WriteGotoIf()
+		if err := c.block(&t); err != nil {
+			return err
+		}
+		c.bc.WriteGotoLabel(start)
+		c.bc.Bind(end)
+	default:
+		c.print()
+	}
+	return nil
+}
+
+// print Compile expression and write its value followed by line break
+func (c *compiler) print() {
+	if !c.expression() {
+		return
+	}
+	c.bc.WriteCommand(vm.InstrWriteInt)
+	c.bc.WritePush('\n')
+	c.bc.WriteCommand(vm.InstrWriteChar)
+	c.endLine()
+}
+
+// define Label of the variable cell, the variable is created on the first assignment
+func (c *compiler) define(name string) vm.Label {
+	l, ok := c.vars[name]
+	if !ok {
+		l = c.bc.NewLabel()
+		c.vars[name] = l
+		c.names = append(c.names, name)
+	}
+	return l
+}
+
+// expression Compile expression up to the end of line, the erroneous line is skipped and false is returned
+func (c *compiler) expression() bool {
+	ok := c.binary(1)
+	if t := c.peek(); ok && t.kind != tokNewline && t.kind != tokEOF {
+		if t.kind == tokClose {
+			c.errorf(t, "unbalanced ): no matching (")
 		} else {
-			ti.Skip()
+			c.errorf(t, "operator expected, found %s", describe(t))
 		}
+		ok = false
 	}
-	for s.Len() > 0 {
-		popOperatorStack(s, bc)
+	if !ok {
+		c.skipLine()
+	}
+	return ok
+}
+
+// binary Compile operand followed by binary operators of the weight or higher (precedence climbing)
+func (c *compiler) binary(weight int) bool {
+	if !c.unary() {
+		return false
+	}
+	for {
+		t := c.peek()
+		if t.kind != tokOperator {
+			return true
+		}
+		w, ok := priority[t.text]
+		if !ok {
+			c.errorf(t, "unknown operator: %s", describe(t))
+			return false
+		}
+		if w < weight {
+			return true
+		}
+		c.next()
+		// Right operand takes only tighter operators, so the same weight is left associative
+		if !c.binary(w + 1) {
+			return false
+		}
+		c.bc.SetSourcePos(t.line, t.col)
+		c.writeOperator(t.text)
 	}
-	bc.WriteCommand(vm.InstrWriteInt)
-	bc.WriteEnd()
-	_, err = bc.WriteTo(w)
-	return err
 }
 
-func popOperatorStack(s *vm.Stack, bc *vm.BytecodeWriter) {
-	so := s.Pop().(operator)
-	switch so.Value {
-	case Plus:
+// unary Compile operand: number, variable, parenthesized expression or unary minus
+func (c *compiler) unary() bool {
+	t := c.next()
+	switch {
+	case t.kind == tokOperator && t.text == string(Minus):
+		if !c.unary() {
+			return false
+		}
+		c.bc.SetSourcePos(t.line, t.col)
+		c.bc.WriteCommand(vm.InstrNegative)
+	case t.kind == tokNumber:
+		c.bc.SetSourcePos(t.line, t.col)
+		c.bc.WritePush(t.value)
+	case t.kind == tokIdent && !isKeyword(t.text):
+		l, ok := c.vars[t.text]
+		if !ok {
+			c.errorf(t, "undefined variable: %s", t.text)
+			return false
+		}
+		c.bc.SetSourcePos(t.line, t.col)
+		c.bc.WriteFetchLabel(l)
+	case t.kind == tokOpen:
+		if !c.binary(1) {
+			return false
+		}
+		if e := c.peek(); e.kind != tokClose {
+			c.errorf(t, "unbalanced (: parenthesis is not closed")
+			return false
+		}
+		c.next()
+	default:
+		if t.kind == tokNewline {
+			// End of line is left for the statement
+			c.unread(t)
+		}
+		c.errorf(t, "operand expected, found %s", describe(t))
+		return false
+	}
+	return true
+}
+
+func (c *compiler) writeOperator(o string) {
+	bc := c.bc
+	switch o {
+	case "+":
 		bc.WriteCommand(vm.InstrPlus)
-		break
-	case Minus:
+	case "-":
 		bc.WriteCommand(vm.InstrMinus)
-		break
-	case Multiply:
+	case "*":
 		bc.WriteCommand(vm.InstrMultiply)
-		break
-	case Divide:
+	case "/":
 		bc.WriteCommand(vm.InstrDivide)
-		break
+	case "%":
+		bc.WriteCommand(vm.InstrMod)
+	case ">":
+		bc.WriteCommand(vm.InstrMore)
+	case "<":
+		bc.WriteCommand(vm.InstrSwap)
+		bc.WriteCommand(vm.InstrMore)
+	case "<=":
+		bc.WriteCommand(vm.InstrMore)
+		bc.WriteCommand(vm.InstrNot)
+	case ">=":
+		bc.WriteCommand(vm.InstrSwap)
+		bc.WriteCommand(vm.InstrMore)
+		bc.WriteCommand(vm.InstrNot)
+	case "==":
+		bc.WriteCommand(vm.InstrEquals)
+	case "!=":
+		bc.WriteCommand(vm.InstrEquals)
+		bc.WriteCommand(vm.InstrNot)
+	}
+}
+
+func isKeyword(s string) bool {
+	switch s {
+	case LET, PRINT, IF, WHILE, END:
+		return true
+	}
+	return false
+}
+
+// describe Token for error messages
+func describe(t token) string {
+	switch t.kind {
+	case tokNumber:
+		return "number"
+	case tokNewline:
+		return "end of line"
+	case tokEOF:
+		return "end of file"
 	}
+	return "'" + t.text + "'"
 }
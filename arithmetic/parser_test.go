@@ -0,0 +1,187 @@
+package arithmetic
+
+import (
+	"bytes"
+	"errors"
+	"false-vm/input"
+	"false-vm/vm"
+	"strings"
+	"testing"
+)
+
+// run Compile and run the program, returns its output
+func run(t *testing.T, src string) (string, error) {
+	w := new(bytes.Buffer)
+	if err := NewParser().Parse(strings.NewReader(src), w); err != nil {
+		return "", err
+	}
+	img, err := vm.DecodeImage(w.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeImage() error = %v", err)
+	}
+	out := new(bytes.Buffer)
+	v := vm.NewVM(4096, 256, 256)
+	v.IO = vm.NewStreamIO(strings.NewReader(""), out)
+	if err = v.LoadImage(img); err != nil {
+		t.Fatalf("LoadImage() error = %v", err)
+	}
+	if err = v.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	return out.String(), nil
+}
+
+func TestParser_Statements(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "check expression is printed",
+			src:  "2 + 2",
+			want: "4\n",
+		},
+		{
+			name: "check variables and print",
+			src:  "let x = 6\nlet y = x * 7\nprint y\r\nx",
+			want: "42\n6\n",
+		},
+		{
+			name: "check unary minus and mod",
+			src:  "print -7 % 3\nprint 7 % -3\nprint - -2",
+			want: "2\n-2\n2\n",
+		},
+		{
+			name: "check comparisons",
+			src:  "1 < 2\n2 < 1\n2 <= 2\n3 >= 4\n3 == 3\n3 != 3\n4 > 3",
+			want: "1\n0\n1\n0\n1\n0\n1\n",
+		},
+		{
+			name: "check if",
+			src:  "let x = 3\nif x > 2\n  print 1\nend\nif x > 5\n  print 2\nend\nprint 3",
+			want: "1\n3\n",
+		},
+		{
+			name: "check while with nested if",
+			src:  "# odd numbers\nlet i = 0\nwhile i < 6\n  if i % 2\n    print i\n  end\n  let i = i + 1\nend",
+			want: "1\n3\n5\n",
+		},
+		{
+			name:    "check undefined variable",
+			src:     "print x",
+			wantErr: true,
+		},
+		{
+			name:    "check block is not closed",
+			src:     "while 1\nprint 1",
+			wantErr: true,
+		},
+		{
+			name:    "check end without block",
+			src:     "print 1\nend",
+			wantErr: true,
+		},
+		{
+			name:    "check missing operand",
+			src:     "let x = 1 +",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := run(t, tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Run() output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_Precedence(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{name: "check minus is left associative", src: "10 - 2 - 3", want: "5"},
+		{name: "check divide is left associative", src: "100 / 10 / 2", want: "5"},
+		{name: "check mod is left associative", src: "20 % 7 % 4", want: "2"},
+		{name: "check plus and minus are left associative", src: "1 - 2 + 3", want: "2"},
+		{name: "check multiply and divide are left associative", src: "8 / 2 * 4", want: "16"},
+		{name: "check multiply and mod are left associative", src: "7 % 3 * 2", want: "2"},
+		{name: "check mod and divide are left associative", src: "17 / 3 % 4", want: "1"},
+		{name: "check multiply over plus", src: "1 + 2 * 3", want: "7"},
+		{name: "check multiply over minus", src: "7 - 2 * 3", want: "1"},
+		{name: "check divide over minus", src: "9 - 6 / 3", want: "7"},
+		{name: "check mod over plus", src: "1 + 7 % 4", want: "4"},
+		{name: "check plus after multiply", src: "2 * 3 + 1", want: "7"},
+		{name: "check parentheses after operator", src: "2 * (3) - 1", want: "5"},
+		{name: "check parentheses override precedence", src: "(1 + 2) * 3", want: "9"},
+		{name: "check parentheses override associativity", src: "2 - (3 - 4)", want: "3"},
+		{name: "check nested parentheses", src: "((((1)))) + ((2) * (3 - (4 - 5)))", want: "9"},
+		{name: "check unary minus over multiply", src: "-2 * 3", want: "-6"},
+		{name: "check unary minus over mod", src: "-2 % 3", want: "1"},
+		{name: "check unary minus after operator", src: "-2 * -3", want: "6"},
+		{name: "check double unary minus", src: "--3", want: "3"},
+		{name: "check unary minus of parentheses", src: "-(2 + 3)", want: "-5"},
+		{name: "check less under plus", src: "1 + 2 < 4", want: "1"},
+		{name: "check greater under minus", src: "5 > 2 - 4", want: "1"},
+		{name: "check less or equal under multiply", src: "2 * 3 <= 5", want: "0"},
+		{name: "check greater or equal under divide", src: "6 / 2 >= 3", want: "1"},
+		{name: "check equal under minus", src: "1 - 1 == 0", want: "1"},
+		{name: "check not equal under mod", src: "5 % 2 != 1", want: "0"},
+		{name: "check comparisons are left associative", src: "3 > 2 > 1", want: "0"},
+		{name: "check equal is left associative", src: "2 == 2 == 1", want: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := run(t, tt.src)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if got != tt.want+"\n" {
+				t.Errorf("Run() output = %q, want %q", got, tt.want+"\n")
+			}
+		})
+	}
+}
+
+func TestParser_ExpressionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{name: "check unclosed parenthesis", src: "print (1 + 2", want: "1:7: error: unbalanced (: parenthesis is not closed"},
+		{name: "check unclosed nested parenthesis", src: "(1 + (2)", want: "1:1: error: unbalanced (: parenthesis is not closed"},
+		{name: "check unmatched parenthesis", src: "1 + 2)", want: "1:6: error: unbalanced ): no matching ("},
+		{name: "check parenthesis before operand", src: ")(", want: "1:1: error: operand expected, found ')'"},
+		{name: "check empty parentheses", src: "\n()", want: "2:2: error: operand expected, found ')'"},
+		{name: "check missing operator", src: "1 2", want: "1:3: error: operator expected, found number"},
+		{name: "check missing operand", src: "1 + * 2", want: "1:5: error: operand expected, found '*'"},
+		{name: "check missing operand at the end of line", src: "1 -\n2", want: "1:4: error: operand expected, found end of line"},
+		{name: "check assign is not an operator", src: "1 = 2", want: "1:3: error: unknown operator: '='"},
+		{name: "check if condition error", src: "if 1 +\n  print 1\nend", want: "1:7: error: operand expected, found end of line"},
+		{name: "check while condition error", src: "while (1\nend\nprint 2", want: "1:7: error: unbalanced (: parenthesis is not closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := run(t, tt.src)
+			if err == nil {
+				t.Fatalf("Parse() error = nil, want %q", tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("Parse() error = %q, want %q", err.Error(), tt.want)
+			}
+			var ce *input.Error
+			if !errors.As(err, &ce) || len(ce.Diagnostics) != 1 {
+				t.Errorf("Parse() error = %v, want 1 diagnostic", err)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package arithmetic
 
 import (
+	"errors"
 	"false-vm/input"
 	"strconv"
 	"unicode"
@@ -15,11 +16,49 @@ const (
 	Minus    rune = '-'
 	Multiply rune = '*'
 	Divide   rune = '/'
+	Mod      rune = '%'
+
+	Less    rune = '<'
+	Greater rune = '>'
+	Assign  rune = '='
+	Not     rune = '!'
 
 	Open  rune = '('
 	Close rune = ')'
+
+	Comment rune = '#'
+)
+
+// Statement keywords
+const (
+	LET   = "let"
+	PRINT = "print"
+	IF    = "if"
+	WHILE = "while"
+	END   = "end"
 )
 
+type tokenKind int
+
+const (
+	tokNumber tokenKind = iota
+	tokIdent
+	tokOperator
+	tokOpen
+	tokClose
+	tokNewline
+	tokEOF
+)
+
+// token Lexeme with its source position
+type token struct {
+	kind  tokenKind
+	text  string
+	value int
+	line  int
+	col   int
+}
+
 func (ti *TokenInput) IsOperand() bool {
 	b := ti.Input.Peek()
 	return unicode.IsDigit(b)
@@ -39,19 +78,41 @@ func (ti *TokenInput) ReadOperand() (int, error) {
 	return v, nil
 }
 
+func (ti *TokenInput) IsIdent() bool {
+	c := ti.Input.Peek()
+	return unicode.IsLetter(c) || c == '_'
+}
+
+func (ti *TokenInput) ReadIdent() string {
+	b := make([]rune, 0)
+	for !ti.Input.Eof() && (ti.IsIdent() || unicode.IsDigit(ti.Input.Peek())) {
+		b = append(b, ti.Input.Next())
+	}
+	return string(b)
+}
+
 func (ti *TokenInput) IsOperator() bool {
 	c := ti.Input.Peek()
 	switch c {
 	case Plus, Minus,
-		Multiply, Divide:
+		Multiply, Divide, Mod,
+		Less, Greater, Assign, Not:
 		return true
 	default:
 		return false
 	}
 }
 
-func (ti *TokenInput) ReadOperator() rune {
-	return ti.Input.Next()
+// ReadOperator Read operator, comparisons may be two chars long
+func (ti *TokenInput) ReadOperator() string {
+	c := ti.Input.Next()
+	switch c {
+	case Less, Greater, Assign, Not:
+		if ti.Input.Peek() == Assign {
+			return string(c) + string(ti.Input.Next())
+		}
+	}
+	return string(c)
 }
 
 func (ti *TokenInput) IsCommaStat() bool {
@@ -62,6 +123,68 @@ func (ti *TokenInput) IsCommaEnd() bool {
 	return ti.Input.Peek() == Close
 }
 
+func (ti *TokenInput) IsNewline() bool {
+	c := ti.Input.Peek()
+	return c == '\n' || c == '\r'
+}
+
+func (ti *TokenInput) IsWhitespace() bool {
+	c := ti.Input.Peek()
+	return c == ' ' || c == '\t'
+}
+
+func (ti *TokenInput) IsComment() bool {
+	return ti.Input.Peek() == Comment
+}
+
+// SkipComment Skip comment up to the end of line
+func (ti *TokenInput) SkipComment() {
+	for !ti.Input.Eof() && !ti.IsNewline() {
+		ti.Input.Next()
+	}
+}
+
+// ReadToken Read the next token skipping whitespaces and comments, CR LF is a single newline, errors are croaked
+func (ti *TokenInput) ReadToken() (token, error) {
+	for ti.IsWhitespace() {
+		ti.Input.Next()
+	}
+	if ti.IsComment() {
+		ti.SkipComment()
+	}
+	line, col := ti.Input.Pos()
+	t := token{line: line, col: col}
+	switch {
+	case ti.Eof():
+		t.kind = tokEOF
+	case ti.IsNewline():
+		if ti.Input.Next() == '\r' && ti.Input.Peek() == '\n' {
+			ti.Input.Next()
+		}
+		t.kind, t.text = tokNewline, "\n"
+	case ti.IsOperand():
+		v, err := ti.ReadOperand()
+		if err != nil {
+			return t, err
+		}
+		t.kind, t.value = tokNumber, v
+	case ti.IsIdent():
+		t.kind, t.text = tokIdent, ti.ReadIdent()
+	case ti.IsOperator():
+		t.kind, t.text = tokOperator, ti.ReadOperator()
+	case ti.IsCommaStat():
+		t.kind, t.text = tokOpen, string(ti.Input.Next())
+	case ti.IsCommaEnd():
+		t.kind, t.text = tokClose, string(ti.Input.Next())
+	default:
+		err := errors.New("unknown operator: " + strconv.QuoteRune(ti.Input.Peek()))
+		ti.Input.Croak(err.Error())
+		ti.Input.Next()
+		return t, err
+	}
+	return t, nil
+}
+
 func (ti *TokenInput) Skip() {
 	ti.Input.Next()
 }
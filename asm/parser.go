@@ -0,0 +1,302 @@
+package asm
+
+import (
+	"errors"
+	"false-vm/input"
+	"false-vm/vm"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	DATA = ".data"
+	ZERO = ".zero"
+	VAR  = ".var"
+)
+
+type Parser struct {
+}
+
+// Mnemonics Instruction codes by lower-cased mnemonic
+var Mnemonics = make(map[string]int)
+
+func init() {
+	for i, info := range vm.Instructions {
+		Mnemonics[strings.ToLower(info.Name)] = i
+	}
+}
+
+// addrOps Instructions with address operands, numbers are relocated the same as labels
+var addrOps = map[int]bool{
+	vm.InstrGoto:  true,
+	vm.InstrStore: true,
+	vm.InstrFetch: true,
+	vm.InstrCopy:  true,
+}
+
+type operand struct {
+	value int
+	label string
+	// col Column of the operand in its line
+	col int
+}
+
+// ref Source position of the label reference
+type ref struct {
+	line int
+	col  int
+}
+
+// assembler Single pass assembly state, label addresses are patched by BytecodeWriter
+type assembler struct {
+	bc     *vm.BytecodeWriter
+	labels map[string]vm.Label
+	// addrs Addresses of the defined labels
+	addrs map[string]int
+	// refs First reference of every label
+	refs  map[string]ref
+	diags *input.Diagnostics
+}
+
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+func init() {
+	input.Register(input.Language{
+		Name:       "asm",
+		Aliases:    []string{"fasm", "assembly"},
+		Extensions: []string{".fasm", ".asm"},
+		New:        func() input.Parser { return NewParser() },
+	})
+}
+
+func (p *Parser) Parse(r io.Reader, w io.Writer) error {
+	diags := input.NewDiagnostics(input.SourceName(r), "")
+	in := input.NewReaderInput(r, diags)
+	ti := TokenInput{Input: in}
+
+	a := &assembler{
+		bc:     vm.NewBytecodeWriter(),
+		labels: make(map[string]vm.Label),
+		addrs:  make(map[string]int),
+		refs:   make(map[string]ref),
+		diags:  diags,
+	}
+	line := 1
+	// Errors are reported to diags, the rest of the erroneous line is skipped to find more errors
+	for !ti.Eof() {
+		ti.SkipWhitespace()
+		if ti.Eof() {
+			break
+		}
+		if ti.IsNewline() {
+			if c := ti.Input.Next(); c == '\r' && ti.Input.Peek() == '\n' {
+				ti.Input.Next()
+			}
+			line++
+		} else if ti.IsComment() {
+			ti.SkipComment()
+		} else if ti.IsIdent() {
+			_, col := ti.Input.Pos()
+			name, err := ti.ReadIdent()
+			if err != nil {
+				ti.SkipComment()
+				continue
+			}
+			if ti.IsLabelEnd() {
+				ti.SkipLabelEnd()
+				if err = a.define(name); err != nil {
+					ti.Input.Croak(err.Error())
+				}
+				continue
+			}
+			a.bc.SetSourcePos(line, col)
+			if err = p.writeStatement(&ti, a, name, line, col); err != nil {
+				ti.SkipComment()
+			}
+		} else {
+			ti.Input.Croak(fmt.Sprintf("unexpected character: %q", ti.Input.Peek()))
+			ti.SkipComment()
+		}
+	}
+
+	if err := in.Err(); err != nil {
+		return err
+	}
+	undefined := make([]string, 0)
+	for name := range a.refs {
+		if _, ok := a.addrs[name]; !ok {
+			undefined = append(undefined, name)
+		}
+	}
+	sort.Slice(undefined, func(i, j int) bool {
+		ri, rj := a.refs[undefined[i]], a.refs[undefined[j]]
+		return ri.line < rj.line || (ri.line == rj.line && ri.col < rj.col)
+	})
+	for _, name := range undefined {
+		diags.Errorf(a.refs[name].line, a.refs[name].col, "undefined label: %s", name)
+	}
+	if err := diags.Err(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(a.addrs))
+	for name := range a.addrs {
+		names = append(names, name)
+	}
+	// Address with several labels gets the first one in order
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		a.bc.AddSymbol(a.addrs[name], name)
+	}
+	_, err := a.bc.WriteTo(w)
+	return err
+}
+
+// writeStatement Read instruction or directive operands and write its code, errors are reported at the statement position
+func (p *Parser) writeStatement(ti *TokenInput, a *assembler, name string, line int, col int) error {
+	args, str, err := p.readOperands(ti)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(name) {
+	case DATA:
+		a.writeOperands(args, line, false)
+		return nil
+	case ZERO:
+		if len(args) != 1 || args[0].label != "" || args[0].value < 0 {
+			return a.errorf(line, col, "zero directive requires words count")
+		}
+		for i := 0; i < args[0].value; i++ {
+			a.bc.WriteInt(0)
+		}
+		return nil
+	case VAR:
+		// Variable is skipped by goto, the same as written by BytecodeWriter.WriteVar
+		if len(args) < 1 || len(args) > 2 || args[0].label == "" {
+			return a.errorf(line, col, "var directive requires name and optional value")
+		}
+		end := a.bc.NewLabel()
+		a.bc.WriteGotoLabel(end)
+		if err = a.define(args[0].label); err != nil {
+			return a.errorf(line, col, err.Error())
+		}
+		v := operand{}
+		if len(args) == 2 {
+			v = args[1]
+		}
+		a.writeOperands([]operand{v}, line, false)
+		a.bc.Bind(end)
+		return nil
+	}
+
+	op, ok := Mnemonics[strings.ToLower(name)]
+	if !ok {
+		return a.errorf(line, col, "unknown mnemonic: "+name)
+	}
+	if op == vm.InstrWriteStr {
+		if str {
+			args = append([]operand{{value: len(args)}}, args...)
+		}
+		if len(args) == 0 || args[0].value != len(args)-1 {
+			return a.errorf(line, col, "string length mismatch")
+		}
+	} else if len(args) != vm.Instructions[op].Args {
+		return a.errorf(line, col, fmt.Sprintf("%s requires %d arguments", vm.InstrName(op), vm.Instructions[op].Args))
+	}
+	a.bc.WriteCommand(op)
+	a.writeOperands(args, line, addrOps[op])
+	return nil
+}
+
+// readOperands Read operands up to the end of line, strings are expanded to chars
+func (p *Parser) readOperands(ti *TokenInput) ([]operand, bool, error) {
+	var args []operand
+	str := false
+	for {
+		ti.SkipWhitespace()
+		if ti.Eof() || ti.IsNewline() || ti.IsComment() {
+			return args, str, nil
+		}
+		_, col := ti.Input.Pos()
+		if ti.IsInt() {
+			v, err := ti.ReadInt()
+			if err != nil {
+				return nil, false, err
+			}
+			args = append(args, operand{value: v})
+		} else if ti.IsCharCode() {
+			v, err := ti.ReadCharCode()
+			if err != nil {
+				return nil, false, err
+			}
+			args = append(args, operand{value: int(v)})
+		} else if ti.IsString() {
+			s, err := ti.ReadString()
+			if err != nil {
+				return nil, false, err
+			}
+			for _, c := range s {
+				args = append(args, operand{value: int(c)})
+			}
+			str = true
+		} else if ti.IsIdent() {
+			l, err := ti.ReadIdent()
+			if err != nil {
+				return nil, false, err
+			}
+			args = append(args, operand{label: l, col: col})
+		} else {
+			return nil, false, p.croak(ti, fmt.Sprintf("unexpected character: %q", ti.Input.Peek()))
+		}
+	}
+}
+
+func (p *Parser) croak(ti *TokenInput, msg string) error {
+	ti.Input.Croak(msg)
+	return errors.New(msg)
+}
+
+func (a *assembler) errorf(line int, col int, msg string) error {
+	a.diags.Errorf(line, col, "%s", msg)
+	return errors.New(msg)
+}
+
+func (a *assembler) label(name string) vm.Label {
+	l, ok := a.labels[name]
+	if !ok {
+		l = a.bc.NewLabel()
+		a.labels[name] = l
+	}
+	return l
+}
+
+// define Bind the label to the current address
+func (a *assembler) define(name string) error {
+	if _, ok := a.addrs[name]; ok {
+		return errors.New("duplicate label: " + name)
+	}
+	a.addrs[name] = a.bc.Len()
+	a.bc.Bind(a.label(name))
+	return nil
+}
+
+// writeOperands Write operands, numbers are written as addresses when addr is set and labels are always addresses
+func (a *assembler) writeOperands(args []operand, line int, addr bool) {
+	for _, arg := range args {
+		switch {
+		case arg.label != "":
+			if _, ok := a.refs[arg.label]; !ok {
+				a.refs[arg.label] = ref{line: line, col: arg.col}
+			}
+			a.bc.WriteIntLabel(a.label(arg.label))
+		case addr:
+			a.bc.WriteAddr(arg.value)
+		default:
+			a.bc.WriteInt(arg.value)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"false-vm/bf"
+	false2 "false-vm/false"
+	"false-vm/input"
+	"false-vm/vm"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, b []byte) *vm.Image {
+	img, err := vm.DecodeImage(b)
+	if err != nil {
+		t.Fatalf("DecodeImage() error = %v", err)
+	}
+	return img
+}
+
+func TestParser_Parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    []int
+		wantErr bool
+	}{
+		{
+			name: "check instructions and comments",
+			str:  "push 1 ; one\nPush -2\nPLUS\nWriteInt\nEnd\n",
+			want: []int{vm.InstrPush, 1, vm.InstrPush, -2, vm.InstrPlus, vm.InstrWriteInt, vm.InstrEnd},
+		},
+		{
+			name: "check char and hex constants",
+			str:  "Push 'a'\nPush '\\n'\nPush 0x10",
+			want: []int{vm.InstrPush, 'a', vm.InstrPush, '\n', vm.InstrPush, 16},
+		},
+		{
+			name: "check forward and backward labels",
+			str:  "start: Goto end\nend: Goto start",
+			want: []int{vm.InstrGoto, 2, vm.InstrGoto, 0},
+		},
+		{
+			name: "check string",
+			str:  "WriteStr \"hi\\n\"",
+			want: []int{vm.InstrWriteStr, 3, 'h', 'i', '\n'},
+		},
+		{
+			name: "check data directives",
+			str:  ".data 1 'a' x\nx: .zero 2",
+			want: []int{1, 'a', 3, 0, 0},
+		},
+		{
+			name: "check var directive",
+			str:  ".var x 7\nFetch x",
+			want: []int{vm.InstrGoto, 3, 7, vm.InstrFetch, 2},
+		},
+		{
+			name:    "check unknown mnemonic",
+			str:     "Jump 1",
+			wantErr: true,
+		},
+		{
+			name:    "check arguments count",
+			str:     "Copy 1",
+			wantErr: true,
+		},
+		{
+			name:    "check undefined label",
+			str:     "Goto nowhere",
+			wantErr: true,
+		},
+		{
+			name:    "check duplicate label",
+			str:     "a: Dup\na: Drop",
+			wantErr: true,
+		},
+		{
+			name:    "check unterminated string",
+			str:     "WriteStr \"hi",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := new(bytes.Buffer)
+			err := NewParser().Parse(strings.NewReader(tt.str), w)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := decode(t, w.Bytes()).Code; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_Diagnostics(t *testing.T) {
+	src := "Push 1\nGoto nowhere\nJump 2\nCopy 1\na: Dup\na: Drop\n"
+	err := NewParser().Parse(strings.NewReader(src), new(bytes.Buffer))
+	var ce *input.Error
+	if !errors.As(err, &ce) {
+		t.Fatalf("Parse() error = %v, want *input.Error", err)
+	}
+	want := []string{
+		"2:6: error: undefined label: nowhere",
+		"3:1: error: unknown mnemonic: Jump",
+		"4:1: error: Copy requires 2 arguments",
+		"6:3: error: duplicate label: a",
+	}
+	got := make([]string, len(ce.Diagnostics))
+	for i, d := range ce.Diagnostics {
+		got[i] = d.Error()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() diagnostics = %q, want %q", got, want)
+	}
+}
+
+func TestParser_RoundTrip(t *testing.T) {
+	parsers := map[string]input.Parser{
+		"../false/samples/*.false": false2.NewParser(),
+		"../bf/samples/*.bf":       bf.NewParser(),
+		"samples/*.fasm":           NewParser(),
+	}
+	for pattern, p := range parsers {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			t.Run(filepath.Base(f), func(t *testing.T) {
+				src, err := os.ReadFile(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				bc := new(bytes.Buffer)
+				if err = p.Parse(bytes.NewReader(src), bc); err != nil {
+					t.Fatalf("Parse() error = %v", err)
+				}
+				listing := new(bytes.Buffer)
+				orig := decode(t, bc.Bytes())
+				if err = vm.WriteListing(listing, orig); err != nil {
+					t.Fatalf("WriteListing() error = %v", err)
+				}
+				got := new(bytes.Buffer)
+				if err = NewParser().Parse(listing, got); err != nil {
+					t.Fatalf("Parse() listing error = %v", err)
+				}
+				if !reflect.DeepEqual(decode(t, got.Bytes()).Code, orig.Code) {
+					t.Errorf("assembled listing differs from the original bytecode")
+				}
+			})
+		}
+	}
+}
+
+func TestParser_OptimizeNumericAddress(t *testing.T) {
+	// Sub at address 4 is called by number, not by label, so it has no relocation
+	src := "Push 4\nCall\nEnd\nPush 42\nWriteInt\nReturn\n"
+	w := new(bytes.Buffer)
+	if err := NewParser().Parse(strings.NewReader(src), w); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	img, err := vm.Optimize(decode(t, w.Bytes()), vm.OptFull)
+	if err != nil {
+		t.Fatalf("Optimize() error = %v", err)
+	}
+	out := new(bytes.Buffer)
+	v := vm.NewVM(1024, 64, 64)
+	v.IO = vm.NewStreamIO(strings.NewReader(""), out)
+	if err = v.LoadImage(img); err != nil {
+		t.Fatalf("LoadImage() error = %v", err)
+	}
+	if err = v.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := out.String(); got != "42" {
+		t.Errorf("Run() output = %q, want %q", got, "42")
+	}
+}
@@ -0,0 +1,171 @@
+package asm
+
+import (
+	"errors"
+	"false-vm/input"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type TokenInput struct {
+	Input input.RuneInput
+}
+
+const (
+	COMMENT    rune = ';'
+	LABEL_END  rune = ':'
+	DIRECTIVE  rune = '.'
+	CHAR_QUOTE rune = '\''
+	STR_QUOTE  rune = '"'
+	ESCAPE     rune = '\\'
+)
+
+func (ti *TokenInput) IsIdent() bool {
+	c := ti.Input.Peek()
+	return unicode.IsLetter(c) || c == '_' || c == DIRECTIVE
+}
+
+func isIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == DIRECTIVE
+}
+
+func (ti *TokenInput) ReadIdent() (string, error) {
+	if !ti.IsIdent() {
+		err := errors.New("not an identifier")
+		ti.Input.Croak(err.Error())
+		return "", err
+	}
+	b := make([]rune, 0)
+	for !ti.Input.Eof() && isIdentChar(ti.Input.Peek()) {
+		b = append(b, ti.Input.Next())
+	}
+	return string(b), nil
+}
+
+func (ti *TokenInput) IsLabelEnd() bool {
+	return ti.Input.Peek() == LABEL_END
+}
+
+func (ti *TokenInput) SkipLabelEnd() {
+	if ti.IsLabelEnd() {
+		ti.Input.Next()
+	}
+}
+
+func (ti *TokenInput) IsInt() bool {
+	c := ti.Input.Peek()
+	return unicode.IsDigit(c) || c == '-'
+}
+
+// ReadInt Read decimal or 0x-prefixed hexadecimal integer
+func (ti *TokenInput) ReadInt() (int, error) {
+	b := make([]rune, 0)
+	if ti.Input.Peek() == '-' {
+		b = append(b, ti.Input.Next())
+	}
+	for !ti.Input.Eof() && (unicode.IsDigit(ti.Input.Peek()) || unicode.IsLetter(ti.Input.Peek())) {
+		b = append(b, ti.Input.Next())
+	}
+	s := string(b)
+	v, err := strconv.ParseInt(s, 0, 32)
+	if err != nil {
+		ti.Input.Croak("invalid integer format: " + s)
+		return 0, err
+	}
+	return int(v), nil
+}
+
+func (ti *TokenInput) IsCharCode() bool {
+	return ti.Input.Peek() == CHAR_QUOTE
+}
+
+// ReadCharCode Read quoted char constant, Go escape sequences are supported
+func (ti *TokenInput) ReadCharCode() (rune, error) {
+	s, err := ti.readQuoted(CHAR_QUOTE)
+	if err != nil {
+		return 0, err
+	}
+	v, _, tail, err := strconv.UnquoteChar(s, byte(CHAR_QUOTE))
+	if err != nil || tail != "" {
+		err = errors.New("invalid char constant: '" + s + "'")
+		ti.Input.Croak(err.Error())
+		return 0, err
+	}
+	return v, nil
+}
+
+func (ti *TokenInput) IsString() bool {
+	return ti.Input.Peek() == STR_QUOTE
+}
+
+// ReadString Read quoted string, Go escape sequences are supported
+func (ti *TokenInput) ReadString() (string, error) {
+	s, err := ti.readQuoted(STR_QUOTE)
+	if err != nil {
+		return "", err
+	}
+	v, err := strconv.Unquote(string(STR_QUOTE) + s + string(STR_QUOTE))
+	if err != nil {
+		err = errors.New("invalid string: \"" + s + "\"")
+		ti.Input.Croak(err.Error())
+		return "", err
+	}
+	return v, nil
+}
+
+func (ti *TokenInput) readQuoted(q rune) (string, error) {
+	if ti.Input.Peek() != q {
+		err := errors.New("not a quoted literal")
+		ti.Input.Croak(err.Error())
+		return "", err
+	}
+	ti.Input.Next()
+	b := strings.Builder{}
+	escaped := false
+	for !ti.Input.Eof() && !ti.IsNewline() {
+		c := ti.Input.Next()
+		if !escaped && c == q {
+			return b.String(), nil
+		}
+		escaped = !escaped && c == ESCAPE
+		b.WriteRune(c)
+	}
+	err := errors.New("unterminated literal")
+	ti.Input.Croak(err.Error())
+	return "", err
+}
+
+func (ti *TokenInput) IsComment() bool {
+	return ti.Input.Peek() == COMMENT
+}
+
+func (ti *TokenInput) SkipComment() {
+	for !ti.Input.Eof() && !ti.IsNewline() {
+		ti.Input.Next()
+	}
+}
+
+func (ti *TokenInput) IsNewline() bool {
+	c := ti.Input.Peek()
+	return c == '\n' || c == '\r'
+}
+
+func (ti *TokenInput) IsWhitespace() bool {
+	c := ti.Input.Peek()
+	return c == ' ' || c == '\t' || c == ','
+}
+
+func (ti *TokenInput) SkipWhitespace() {
+	for ti.IsWhitespace() {
+		ti.Input.Next()
+	}
+}
+
+func (ti *TokenInput) Skip() {
+	ti.Input.Next()
+}
+
+func (ti *TokenInput) Eof() bool {
+	return ti.Input.Eof()
+}
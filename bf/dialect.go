@@ -0,0 +1,76 @@
+package bf
+
+import "fmt"
+
+const (
+	DefaultTapeSize = 30720
+	DefaultCellBits = 32
+)
+
+// PointerMode Behavior of tape pointer moved out of the tape
+type PointerMode int
+
+const (
+	// PointerCheck Write PointerFaultMessage and fault with out of bounds error
+	PointerCheck PointerMode = iota
+	// PointerWrap Wrap around to the other end of the tape
+	PointerWrap
+)
+
+// PointerFaultMessage Output written before the fault of tape pointer moved out of the tape
+const PointerFaultMessage = "tape pointer out of range"
+
+var pointerModes = map[string]PointerMode{
+	"check": PointerCheck,
+	"wrap":  PointerWrap,
+}
+
+func (m PointerMode) String() string {
+	for s, v := range pointerModes {
+		if v == m {
+			return s
+		}
+	}
+	return "unknown"
+}
+
+func ParsePointerMode(s string) (PointerMode, error) {
+	if m, ok := pointerModes[s]; ok {
+		return m, nil
+	}
+	return 0, fmt.Errorf("unknown pointer mode: %s", s)
+}
+
+// EOFMode Value stored to the cell by input command at the end of input
+type EOFMode int
+
+const (
+	// EOFZero Store zero
+	EOFZero EOFMode = iota
+	// EOFMinusOne Store -1 (wrapped to the cell width)
+	EOFMinusOne
+	// EOFUnchanged Leave the cell unchanged
+	EOFUnchanged
+)
+
+var eofModes = map[string]EOFMode{
+	"0":         EOFZero,
+	"-1":        EOFMinusOne,
+	"unchanged": EOFUnchanged,
+}
+
+func (m EOFMode) String() string {
+	for s, v := range eofModes {
+		if v == m {
+			return s
+		}
+	}
+	return "unknown"
+}
+
+func ParseEOFMode(s string) (EOFMode, error) {
+	if m, ok := eofModes[s]; ok {
+		return m, nil
+	}
+	return 0, fmt.Errorf("unknown EOF mode: %s", s)
+}
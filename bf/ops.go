@@ -0,0 +1,150 @@
+package bf
+
+type opKind int
+
+const (
+	opAdd opKind = iota
+	opMove
+	opIn
+	opOut
+	opLoop
+	opEnd
+	// opClear Loop [-] or [+] setting the current cell to zero
+	opClear
+	// opMul Loop like [->+>++<<] adding the current cell multiplied by factors to other cells and clearing it
+	opMul
+)
+
+// op Command or a run of commands folded to one operation
+type op struct {
+	kind opKind
+	// n Value added to the cell or pointer
+	n    int
+	muls []mul
+	line int
+	col  int
+}
+
+// mul Cell at the offset from the pointer gets the current cell multiplied by factor
+type mul struct {
+	offset int
+	factor int
+}
+
+// token Command with its source position
+type token struct {
+	cmd  rune
+	line int
+	col  int
+}
+
+// translate Translate every command to a separate operation
+func translate(tokens []token) []op {
+	ops := make([]op, 0, len(tokens))
+	for _, t := range tokens {
+		o := op{line: t.line, col: t.col}
+		switch t.cmd {
+		case NEXT, PREV:
+			o.kind, o.n = opMove, delta(t.cmd)
+		case PLUS, MINUS:
+			o.kind, o.n = opAdd, delta(t.cmd)
+		case IN:
+			o.kind = opIn
+		case OUT:
+			o.kind = opOut
+		case SUB:
+			o.kind = opLoop
+		case RETURN:
+			o.kind = opEnd
+		}
+		ops = append(ops, o)
+	}
+	return ops
+}
+
+// fold Fold runs of + - > < to single operations and recognize clear and copy/multiply loops
+func fold(tokens []token) []op {
+	ops := make([]op, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch t.cmd {
+		case NEXT, PREV, PLUS, MINUS:
+			kind := opAdd
+			if t.cmd == NEXT || t.cmd == PREV {
+				kind = opMove
+			}
+			n := 0
+			for ; i < len(tokens) && sameKind(tokens[i].cmd, t.cmd); i++ {
+				n += delta(tokens[i].cmd)
+			}
+			i--
+			if n != 0 {
+				ops = append(ops, op{kind: kind, n: n, line: t.line, col: t.col})
+			}
+			continue
+		case SUB:
+			if o, n, ok := foldLoop(tokens[i:]); ok {
+				ops = append(ops, o)
+				i += n - 1
+				continue
+			}
+		}
+		ops = append(ops, translate(tokens[i:i+1])...)
+	}
+	return ops
+}
+
+// foldLoop Recognize loop at the start of tokens, returns operation and number of tokens it replaces
+func foldLoop(tokens []token) (op, int, bool) {
+	cells := make(map[int]int)
+	var offsets []int
+	ptr := 0
+	for i := 1; i < len(tokens); i++ {
+		switch c := tokens[i].cmd; c {
+		case NEXT, PREV:
+			ptr += delta(c)
+		case PLUS, MINUS:
+			if _, ok := cells[ptr]; !ok && ptr != 0 {
+				offsets = append(offsets, ptr)
+			}
+			cells[ptr] += delta(c)
+		case RETURN:
+			o := op{line: tokens[0].line, col: tokens[0].col}
+			if ptr != 0 {
+				return o, 0, false
+			}
+			step := cells[0]
+			if len(offsets) == 0 && (step == -1 || step == 1) {
+				o.kind = opClear
+				return o, i + 1, true
+			}
+			// Only decrementing loop runs exactly value times
+			if step != -1 {
+				return o, 0, false
+			}
+			o.kind = opMul
+			for _, off := range offsets {
+				if cells[off] != 0 {
+					o.muls = append(o.muls, mul{offset: off, factor: cells[off]})
+				}
+			}
+			return o, i + 1, true
+		default:
+			return op{}, 0, false
+		}
+	}
+	return op{}, 0, false
+}
+
+func delta(c rune) int {
+	if c == NEXT || c == PLUS {
+		return 1
+	}
+	return -1
+}
+
+func sameKind(a rune, b rune) bool {
+	move := func(c rune) bool { return c == NEXT || c == PREV }
+	add := func(c rune) bool { return c == PLUS || c == MINUS }
+	return (move(a) && move(b)) || (add(a) && add(b))
+}
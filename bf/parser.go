@@ -3,137 +3,220 @@ package bf
 import (
 	"false-vm/input"
 	"false-vm/vm"
+	"fmt"
 	"io"
 )
 
 type Parser struct {
+	// Naive Translate every command separately, without folding runs and recognizing idioms
+	Naive bool
+	// TapeSize Number of tape cells, DefaultTapeSize if zero
+	TapeSize int
+	// CellBits Cell width: 8 and 16-bit cells wrap around, 32-bit ones follow the VM arithmetic mode
+	CellBits int
+	// Pointer Behavior of tape pointer moved out of the tape
+	Pointer PointerMode
+	// EOF Value stored by input command at the end of input
+	EOF EOFMode
+	// Echo Write every char read by input command back to output, for terminals in raw mode
+	Echo bool
+	// CRToLF Store CR read by input command as LF, Enter key gives CR in terminal raw mode
+	CRToLF bool
 }
 
 func NewParser() *Parser {
-	return &Parser{}
+	return &Parser{TapeSize: DefaultTapeSize, CellBits: DefaultCellBits}
+}
+
+func init() {
+	input.Register(input.Language{
+		Name:       "bf",
+		Aliases:    []string{"brainfuck"},
+		Extensions: []string{".bf", ".b"},
+		New:        func() input.Parser { return NewParser() },
+	})
 }
 
 func (p *Parser) Parse(r io.Reader, w io.Writer) error {
-	data, err := io.ReadAll(r)
-	if err != nil {
-		return err
+	diags := input.NewDiagnostics(input.SourceName(r), "")
+	in := input.NewReaderInput(r, diags)
+	ti := TokenInput{Input: in}
+
+	tapeSize := p.TapeSize
+	if tapeSize == 0 {
+		tapeSize = DefaultTapeSize
+	}
+	if tapeSize < 0 {
+		return fmt.Errorf("invalid tape size: %d", tapeSize)
+	}
+	cellBits := p.CellBits
+	if cellBits == 0 {
+		cellBits = DefaultCellBits
+	}
+	if cellBits != 8 && cellBits != 16 && cellBits != 32 {
+		return fmt.Errorf("unsupported cell width: %d", cellBits)
 	}
-	ti := TokenInput{Input: &input.StringInput{Str: string(data)}}
 
 	bc := vm.NewBytecodeWriter()
 
 	bc.BlockCreate()
-	for i := 0; i < 30720; i++ {
+	for i := 0; i < tapeSize; i++ {
 		bc.WriteInt(0)
 	}
 	mem, err := bc.BlockSkip()
 	if err != nil {
 		return err
 	}
-	mp := bc.WriteVar(mem)
+	mp := bc.WriteVarAddr(mem)
+	bc.AddSymbol(mem, "tape")
+	bc.AddSymbol(mp, "ptr")
+	t := tape{bc: bc, mem: mem, size: tapeSize, bits: cellBits, pointer: p.Pointer}
 
+	var tokens []token
 	for !ti.Eof() {
 		if !ti.IsCommand() {
 			ti.Skip()
+			continue
 		}
-		cmd := ti.Next()
-		switch cmd {
-		case NEXT:
-			bc.WriteFetch(mp)
-			bc.WritePush(1)
-			bc.WriteCommand(vm.InstrPlus)
-			bc.WriteStore(mp)
-			break
-		case PREV:
+		line, col := ti.Input.Pos()
+		tokens = append(tokens, token{cmd: ti.Next(), line: line, col: col})
+	}
+	if err = in.Err(); err != nil {
+		return err
+	}
+	checkLoops(tokens, diags)
+	if err = diags.Err(); err != nil {
+		return err
+	}
+	var ops []op
+	if p.Naive {
+		ops = translate(tokens)
+	} else {
+		ops = fold(tokens)
+	}
+
+	for _, o := range ops {
+		bc.SetSourcePos(o.line, o.col)
+		switch o.kind {
+		case opMove:
 			bc.WriteFetch(mp)
-			bc.WritePush(1)
-			bc.WriteCommand(vm.InstrMinus)
+			writeAdd(bc, o.n)
+			t.writeBound()
 			bc.WriteStore(mp)
-			break
-		case PLUS:
+		case opAdd:
 			bc.WriteFetch(mp)
 			bc.WriteCommand(vm.InstrDup)
-			bc.WriteStore(bc.Len() + 10)
-			bc.WriteStore(bc.Len() + 3)
-			bc.WriteFetch(0) // Stub address, will be written by command before
-			bc.WritePush(1)
-			bc.WriteCommand(vm.InstrPlus)
-			bc.WriteStore(0)
-			break
-		case MINUS:
+			bc.WriteCommand(vm.InstrFetchI)
+			writeAdd(bc, o.n)
+			t.writeWrap()
+			bc.WriteCommand(vm.InstrSwap)
+			bc.WriteCommand(vm.InstrStoreI)
+		case opClear:
+			bc.WritePush(0)
 			bc.WriteFetch(mp)
-			bc.WriteCommand(vm.InstrDup)
-			bc.WriteStore(bc.Len() + 10)
-			bc.WriteStore(bc.Len() + 3)
-			bc.WriteFetch(0) // Stub address, will be written by command before
-			bc.WritePush(1)
-			bc.WriteCommand(vm.InstrMinus)
-			bc.WriteStore(0)
-			break
-		case IN:
-			// Read char
+			bc.WriteCommand(vm.InstrStoreI)
+		case opMul:
+			// Skip the loop as a whole on zero cell, its target cells may be out of the tape
+			skip := bc.NewLabel()
+			bc.WriteFetch(mp)
+			bc.WriteCommand(vm.InstrFetchI)
+			bc.WritePush(0)
+			bc.WriteCommand(vm.InstrEquals)
+			bc.WritePushLabel(skip)
+			bc.WriteGotoIf()
+			for _, m := range o.muls {
+				// Target cell address and value
+				bc.WriteFetch(mp)
+				writeAdd(bc, m.offset)
+				t.writeBound()
+				bc.WriteCommand(vm.InstrDup)
+				bc.WriteCommand(vm.InstrFetchI)
+				// Current cell multiplied by factor
+				bc.WriteFetch(mp)
+				bc.WriteCommand(vm.InstrFetchI)
+				f, add := m.factor, vm.InstrPlus
+				if f < 0 {
+					f, add = -f, vm.InstrMinus
+				}
+				if f != 1 {
+					bc.WritePush(f)
+					bc.WriteCommand(vm.InstrMultiply)
+				}
+				bc.WriteCommand(add)
+				t.writeWrap()
+				bc.WriteCommand(vm.InstrSwap)
+				bc.WriteCommand(vm.InstrStoreI)
+			}
+			bc.WritePush(0)
+			bc.WriteFetch(mp)
+			bc.WriteCommand(vm.InstrStoreI)
+			bc.Bind(skip)
+		case opIn:
+			// Read char and handle end of input separately
+			eof, done := bc.NewLabel(), bc.NewLabel()
 			bc.WriteCommand(vm.InstrReadChar)
-
-			// Minus 13 to determine CR
-			bc.WritePush(13)
-			bc.WriteCommand(vm.InstrMinus)
 			bc.WriteCommand(vm.InstrDup)
+			bc.WritePush(-1)
+			bc.WriteCommand(vm.InstrEquals)
+			bc.WritePushLabel(eof)
+			bc.WriteGotoIf()
 
-			// Sub correct value if it is not CR
-			bc.SubCreate()
-			bc.WritePush(13)
-			bc.WriteCommand(vm.InstrPlus)
-			if err = bc.SubReturn(); err != nil {
-				ti.Input.Croak(err.Error())
-				return err
+			if p.CRToLF {
+				// Replace CR by sub called on equality
+				bc.WriteCommand(vm.InstrDup)
+				bc.WritePush('\r')
+				bc.WriteCommand(vm.InstrEquals)
+				bc.SubCreate()
+				bc.WriteCommand(vm.InstrDrop)
+				bc.WritePush('\n')
+				if err = bc.SubReturn(); err != nil {
+					return err
+				}
+				bc.WriteCallIf()
 			}
-			bc.WriteCallIf()
-
-			// Log purpose only
-			bc.WriteCommand(vm.InstrDup)
-			bc.WriteCommand(vm.InstrDup)
-			bc.WriteCommand(vm.InstrWriteChar)
-
-			// Add line break on CR
-			bc.WriteCommand(vm.InstrNot)
-			bc.SubCreate()
-			bc.WritePush('\n')
-			bc.WriteCommand(vm.InstrWriteChar)
-			if err = bc.SubReturn(); err != nil {
-				ti.Input.Croak(err.Error())
-				return err
+			if p.Echo {
+				bc.WriteCommand(vm.InstrDup)
+				bc.WriteCommand(vm.InstrWriteChar)
+				bc.WriteCommand(vm.InstrFlush)
 			}
-			bc.WriteCallIf()
-
-			bc.WriteCommand(vm.InstrFlush)
 
 			// Store value to current cell
+			t.writeWrap()
 			bc.WriteFetch(mp)
-			bc.WriteStore(bc.Len() + 3)
-			bc.WriteStore(0) // Stub address, will be written by command before
-			break
-		case OUT:
+			bc.WriteCommand(vm.InstrStoreI)
+			bc.WriteGotoLabel(done)
+
+			bc.Bind(eof)
+			switch p.EOF {
+			case EOFZero:
+				bc.WriteCommand(vm.InstrDrop)
+				bc.WritePush(0)
+			case EOFMinusOne:
+				t.writeWrap()
+			}
+			if p.EOF == EOFUnchanged {
+				bc.WriteCommand(vm.InstrDrop)
+			} else {
+				bc.WriteFetch(mp)
+				bc.WriteCommand(vm.InstrStoreI)
+			}
+			bc.Bind(done)
+		case opOut:
 			bc.WriteFetch(mp)
-			bc.WriteStore(bc.Len() + 3)
-			bc.WriteFetch(0) // Stub address, will be written by command before
+			bc.WriteCommand(vm.InstrFetchI)
 			bc.WriteCommand(vm.InstrWriteChar)
 			bc.WriteCommand(vm.InstrFlush)
-			break
-		case SUB:
+		case opLoop:
 			// Create conditional sub
 			bc.SubCreate()
 			bc.WriteFetch(mp)
-			bc.WriteStore(bc.Len() + 3)
-			bc.WriteFetch(0) // Stub address, will be written by command before
+			bc.WriteCommand(vm.InstrFetchI)
 			if err = bc.SubReturn(); err != nil {
-				ti.Input.Croak(err.Error())
 				return err
 			}
 			bc.SubCreate()
-			break
-		case RETURN:
+		case opEnd:
 			if err = bc.SubReturn(); err != nil {
-				ti.Input.Croak(err.Error())
 				return err
 			}
 			// Reserved condition and body addresses
@@ -154,13 +237,110 @@ func (p *Parser) Parse(r io.Reader, w io.Writer) error {
 			bc.WriteFetch(ca)
 			bc.WriteCall()
 			// Push to stack call body address
-			bc.WritePush(bca)
+			bc.WritePushAddr(bca)
 			// Call condition
 			bc.WriteGotoIf()
-			break
 		}
 	}
 	bc.WriteEnd()
+	t.writeFault()
 	_, err = bc.WriteTo(w)
 	return err
 }
+
+// checkLoops Report all unbalanced loop brackets
+func checkLoops(tokens []token, diags *input.Diagnostics) {
+	var open []token
+	for _, t := range tokens {
+		switch t.cmd {
+		case SUB:
+			open = append(open, t)
+		case RETURN:
+			if len(open) == 0 {
+				diags.Errorf(t.line, t.col, "unbalanced ]: loop end without start")
+				continue
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	for _, t := range open {
+		diags.Errorf(t.line, t.col, "unbalanced [: loop is not closed")
+	}
+}
+
+// tape Emitter of the tape dialect specific code
+type tape struct {
+	bc      *vm.BytecodeWriter
+	mem     int
+	size    int
+	bits    int
+	pointer PointerMode
+	// fault Sub writing the pointer fault message, it is created by the first pointer check
+	fault *vm.Label
+}
+
+// writeBound Check or wrap the cell address on the top of stack
+func (t *tape) writeBound() {
+	bc := t.bc
+	switch t.pointer {
+	case PointerWrap:
+		bc.WritePushAddr(t.mem)
+		bc.WriteCommand(vm.InstrMinus)
+		bc.WritePush(t.size)
+		bc.WriteCommand(vm.InstrMod)
+		bc.WritePushAddr(t.mem)
+		bc.WriteCommand(vm.InstrPlus)
+	default:
+		// Offset from the tape start is unchanged by modulo only inside the tape
+		bc.WriteCommand(vm.InstrDup)
+		bc.WritePushAddr(t.mem)
+		bc.WriteCommand(vm.InstrMinus)
+		bc.WriteCommand(vm.InstrDup)
+		bc.WritePush(t.size)
+		bc.WriteCommand(vm.InstrMod)
+		bc.WriteCommand(vm.InstrEquals)
+		ok := bc.NewLabel()
+		bc.WritePushLabel(ok)
+		bc.WriteGotoIf()
+		// Explain the fault, then fault with out of bounds error at the command moved the pointer
+		if t.fault == nil {
+			l := bc.NewLabel()
+			t.fault = &l
+		}
+		bc.WritePushLabel(*t.fault)
+		bc.WriteCommand(vm.InstrCall)
+		bc.WritePush(-1)
+		bc.WriteCommand(vm.InstrFetchI)
+		bc.Bind(ok)
+	}
+}
+
+// writeFault Write the pointer fault message sub if any pointer check calls it
+func (t *tape) writeFault() {
+	if t.fault == nil {
+		return
+	}
+	t.bc.Bind(*t.fault)
+	t.bc.WriteString(PointerFaultMessage + "\n")
+	t.bc.WriteCommand(vm.InstrFlush)
+	t.bc.WriteCommand(vm.InstrReturn)
+}
+
+// writeWrap Wrap the cell value on the top of stack to the cell width
+func (t *tape) writeWrap() {
+	if t.bits < 32 {
+		t.bc.WritePush(1 << t.bits)
+		t.bc.WriteCommand(vm.InstrMod)
+	}
+}
+
+// writeAdd Add constant to the top of stack
+func writeAdd(bc *vm.BytecodeWriter, n int) {
+	if n < 0 {
+		bc.WritePush(-n)
+		bc.WriteCommand(vm.InstrMinus)
+	} else {
+		bc.WritePush(n)
+		bc.WriteCommand(vm.InstrPlus)
+	}
+}
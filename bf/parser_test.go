@@ -0,0 +1,268 @@
+package bf
+
+import (
+	"bytes"
+	"errors"
+	"false-vm/vm"
+	"os"
+	"strings"
+	"testing"
+)
+
+func compile(tb testing.TB, p *Parser, src string) *vm.Image {
+	w := new(bytes.Buffer)
+	if err := p.Parse(strings.NewReader(src), w); err != nil {
+		tb.Fatalf("Parse() error = %v", err)
+	}
+	img, err := vm.DecodeImage(w.Bytes())
+	if err != nil {
+		tb.Fatalf("DecodeImage() error = %v", err)
+	}
+	return img
+}
+
+func run(tb testing.TB, img *vm.Image, in string) string {
+	out := new(bytes.Buffer)
+	v := vm.NewVM(65536, 1024, 1024)
+	v.IO = vm.NewStreamIO(strings.NewReader(in), out)
+	if err := v.LoadImage(img); err != nil {
+		tb.Fatalf("LoadImage() error = %v", err)
+	}
+	if err := v.Run(); err != nil {
+		tb.Fatalf("Run() error = %v", err)
+	}
+	return out.String()
+}
+
+func TestParser_Parse(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "check runs are folded",
+			src:  "++++++++[>++++++++<-]>+.+. >><<-- -.",
+			want: "AB?",
+		},
+		{
+			name: "check cancelled runs",
+			src:  "+-+-++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++><.",
+			want: "@",
+		},
+		{
+			name: "check clear loop",
+			src:  "++++++++[>++++++++<-]>+[-]+++++++++++++++++++++++++++++++++++++++++++++++++.",
+			want: "1",
+		},
+		{
+			name: "check copy and multiply loop",
+			src:  "+++++++[>++++>+++++++++<<-]>>---.<--.",
+			want: "<\x1a",
+		},
+		{
+			name: "check multiply loop with negative factor",
+			src:  "++++++++[>++++++++<-]>+++[>+>--<<-]>.>+++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++.",
+			want: "C+",
+		},
+		{
+			name: "check loop with output is not folded",
+			src:  "+++[>++++++++++++++++++++++++++++++++++++++++++++++++.<-]",
+			want: "0`\u0090",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			naive := compile(t, &Parser{Naive: true}, tt.src)
+			folded := compile(t, NewParser(), tt.src)
+			if got := run(t, naive, ""); got != tt.want {
+				t.Errorf("naive Run() output = %q, want %q", got, tt.want)
+			}
+			if got := run(t, folded, ""); got != tt.want {
+				t.Errorf("Run() output = %q, want %q", got, tt.want)
+			}
+			if len(folded.Code) >= len(naive.Code) {
+				t.Errorf("Parse() code size = %d, naive %d", len(folded.Code), len(naive.Code))
+			}
+		})
+	}
+}
+
+func TestParser_Dialect(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       Parser
+		src     string
+		in      string
+		want    string
+		wantErr error
+	}{
+		{
+			name: "check 8-bit cell wraps below zero",
+			p:    Parser{CellBits: 8},
+			src:  "-.",
+			want: "\u00ff",
+		},
+		{
+			name: "check 8-bit cell wraps in multiply loop",
+			p:    Parser{CellBits: 8},
+			src:  "++++++++++++++++[>++++++++++++++++<-]>+.",
+			want: "\x01",
+		},
+		{
+			name: "check 16-bit cell wraps below zero",
+			p:    Parser{CellBits: 16},
+			src:  "-.",
+			want: "\uffff",
+		},
+		{
+			name: "check pointer wraps around tape",
+			p:    Parser{TapeSize: 4, Pointer: PointerWrap},
+			src:  "<+++++++++++++++++++++++++++++++++++++++++++++++++.>>>>.",
+			want: "11",
+		},
+		{
+			name:    "check pointer out of tape end",
+			p:       Parser{TapeSize: 4},
+			src:     ">>>>+",
+			want:    PointerFaultMessage + "\n",
+			wantErr: vm.ErrOutOfBounds,
+		},
+		{
+			name:    "check pointer out of tape start",
+			p:       Parser{TapeSize: 4},
+			src:     "<+",
+			want:    PointerFaultMessage + "\n",
+			wantErr: vm.ErrOutOfBounds,
+		},
+		{
+			name: "check skipped multiply loop at tape start",
+			src:  "[-<+>]++++++++[->++++++++<]>+.",
+			want: "A",
+		},
+		{
+			name: "check skipped multiply loop at tape end",
+			p:    Parser{TapeSize: 4},
+			src:  ">>>[->+<]+++++++++++++++++++++++++++++++++++++++++++++++++.",
+			want: "1",
+		},
+		{
+			name: "check input is not echoed",
+			src:  ",.",
+			in:   "A",
+			want: "A",
+		},
+		{
+			name: "check input is echoed",
+			p:    Parser{Echo: true},
+			src:  ",.",
+			in:   "A",
+			want: "AA",
+		},
+		{
+			name: "check CR is read as is",
+			src:  ",.",
+			in:   "\r",
+			want: "\r",
+		},
+		{
+			name: "check CR is read as LF",
+			p:    Parser{CRToLF: true},
+			src:  ",.,.",
+			in:   "\ra",
+			want: "\na",
+		},
+		{
+			name: "check zero on end of input",
+			src:  "+,.",
+			want: "\x00",
+		},
+		{
+			name: "check minus one on end of input",
+			p:    Parser{CellBits: 8, EOF: EOFMinusOne},
+			src:  "+,.",
+			want: "\u00ff",
+		},
+		{
+			name: "check cell unchanged on end of input",
+			p:    Parser{EOF: EOFUnchanged},
+			src:  "+++++++++++++++++++++++++++++++++++++++++++++++++,.",
+			want: "1",
+		},
+	}
+	for _, tt := range tests {
+		for _, naive := range []bool{true, false} {
+			t.Run(tt.name, func(t *testing.T) {
+				p := tt.p
+				p.Naive = naive
+				img := compile(t, &p, tt.src)
+				out := new(bytes.Buffer)
+				v := vm.NewVM(65536, 1024, 1024)
+				v.IO = vm.NewStreamIO(strings.NewReader(tt.in), out)
+				if err := v.LoadImage(img); err != nil {
+					t.Fatalf("LoadImage() error = %v", err)
+				}
+				if err := v.Run(); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if got := out.String(); got != tt.want {
+					t.Errorf("Run() output = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestParser_PointerFault(t *testing.T) {
+	for _, naive := range []bool{true, false} {
+		p := Parser{Naive: naive, TapeSize: 4}
+		img := compile(t, &p, "+.\n+<<.")
+		out := new(bytes.Buffer)
+		v := vm.NewVM(65536, 1024, 1024)
+		v.IO = vm.NewStreamIO(strings.NewReader(""), out)
+		if err := v.LoadImage(img); err != nil {
+			t.Fatalf("LoadImage() error = %v", err)
+		}
+		var f *vm.VMFault
+		if err := v.Run(); !errors.As(err, &f) || !errors.Is(err, vm.ErrOutOfBounds) {
+			t.Fatalf("Run() error = %v, want out of bounds fault", err)
+		}
+		if want := "\x01tape pointer out of range\n"; out.String() != want {
+			t.Errorf("Run() output = %q, want %q", out.String(), want)
+		}
+		if f.Source != ":2:2" {
+			t.Errorf("fault source = %q, want %q", f.Source, ":2:2")
+		}
+	}
+}
+
+// BenchmarkParser_Run Compare running time of naive and folded code on the bundled samples
+func BenchmarkParser_Run(b *testing.B) {
+	samples := []struct {
+		file string
+		in   string
+	}{
+		{file: "samples/hello.bf"},
+		{file: "samples/quicksort.bf", in: "zyxwvutsrqponmlkjihgfedcba"},
+		{file: "samples/tic-tac-toe.bf", in: "1\n2\n3\n4\n5\n6\n7\n8\n9\n"},
+		{file: "samples/xmas-tree.bf", in: "9\n"},
+	}
+	for _, s := range samples {
+		src, err := os.ReadFile(s.file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, naive := range []bool{true, false} {
+			name := strings.TrimSuffix(strings.TrimPrefix(s.file, "samples/"), ".bf") + "/folded"
+			if naive {
+				name = strings.TrimSuffix(name, "folded") + "naive"
+			}
+			img := compile(b, &Parser{Naive: naive}, string(src))
+			b.Run(name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					run(b, img, s.in)
+				}
+			})
+		}
+	}
+}
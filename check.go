@@ -0,0 +1,41 @@
+package main
+
+import (
+	"false-vm/engine"
+	false2 "false-vm/false"
+	"false-vm/input"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func checkCommand(args []string) {
+	var src string
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.StringVar(&src, "s", "", "FALSE source file")
+	_ = fs.Parse(args)
+	if src == "" && fs.NArg() > 0 {
+		src = fs.Arg(0)
+	}
+	if src == "" {
+		log.Fatalln("source file is required")
+	}
+
+	r, err := engine.OpenSource(src)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	defer r.Close()
+	warns, err := false2.Check(r)
+	if err != nil {
+		fatal(err)
+	}
+	if err = input.Render(os.Stdout, warns); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if len(warns) > 0 {
+		fmt.Printf("%d warning(s)\n", len(warns))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	vm2 "false-vm/vm"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const debugHelp = `commands:
+  s, step [n]             execute n instructions (default 1)
+  n, next                 execute instruction, stepping over calls
+  c, continue             run until breakpoint, watchpoint or program end
+  b, break <addr>         set breakpoint
+  d, delete <addr>        delete breakpoint
+  w, watch <addr>         stop when memory cell is written
+  u, unwatch <addr>       delete watchpoint
+  bt, backtrace           print call stack
+  p, print stack          print op stack, topmost first
+  p, print mem <from> [to] print memory range
+  i, info                 print instruction pointer, breakpoints and watchpoints
+  q, quit                 exit debugger
+`
+
+type debugger struct {
+	vm  *vm2.VM
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func debugCommand(args []string) {
+	var pf programFlags
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	pf.register(fs)
+	_ = fs.Parse(args)
+
+	prog, err := pf.image()
+	if err != nil {
+		fatal(err)
+	}
+	opts, err := pf.runOptions()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	// Program input and debugger commands share the same reader
+	in := bufio.NewReader(os.Stdin)
+	opts.IO = vm2.NewStreamIO(in, os.Stdout)
+	vm, err := prog.NewVM(opts)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	d := &debugger{vm: vm, in: in, out: os.Stdout}
+	d.loop()
+}
+
+func (d *debugger) loop() {
+	d.printLocation()
+	for {
+		_ = d.vm.IO.Flush()
+		_, _ = fmt.Fprint(d.out, "(fdb) ")
+		line, err := d.in.ReadString('\n')
+		if err != nil && line == "" {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if quit := d.exec(f[0], f[1:]); quit {
+			return
+		}
+	}
+}
+
+func (d *debugger) exec(cmd string, args []string) bool {
+	ctx := context.Background()
+	switch cmd {
+	case "s", "step":
+		n := 1
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil {
+				d.printf("invalid count: %s\n", args[0])
+				return false
+			}
+		}
+		for i := 0; i < n; i++ {
+			e, err := d.vm.Step()
+			if e != nil || err != nil {
+				d.stopped(e, err)
+				return false
+			}
+		}
+		d.printLocation()
+	case "n", "next":
+		d.stopped(d.vm.StepOver(ctx))
+	case "c", "continue":
+		d.stopped(d.vm.Continue(ctx))
+	case "b", "break":
+		if addr, ok := d.addr(args); ok {
+			d.vm.SetBreakpoint(addr)
+			d.printf("breakpoint at %d\n", addr)
+		}
+	case "d", "delete":
+		if addr, ok := d.addr(args); ok {
+			d.vm.ClearBreakpoint(addr)
+		}
+	case "w", "watch":
+		if addr, ok := d.addr(args); ok {
+			d.vm.Watch(addr)
+			d.printf("watchpoint at %d\n", addr)
+		}
+	case "u", "unwatch":
+		if addr, ok := d.addr(args); ok {
+			d.vm.Unwatch(addr)
+		}
+	case "bt", "backtrace":
+		d.printf("#0 %d%s\n", d.vm.IP(), d.source(d.vm.IP()))
+		for i, addr := range d.vm.Backtrace() {
+			d.printf("#%d %d%s\n", i+1, addr, d.source(addr))
+		}
+	case "p", "print":
+		d.print(args)
+	case "i", "info":
+		d.printLocation()
+		d.printf("breakpoints: %v\nwatchpoints: %v\n", d.vm.Breakpoints(), d.vm.Watchpoints())
+	case "h", "help":
+		d.printf(debugHelp)
+	case "q", "quit":
+		return true
+	default:
+		d.printf("unknown command: %s, type help to list commands\n", cmd)
+	}
+	return false
+}
+
+func (d *debugger) print(args []string) {
+	if len(args) == 0 {
+		d.printf("print what: stack or mem?\n")
+		return
+	}
+	switch args[0] {
+	case "stack":
+		d.printf("%v\n", d.vm.OpStack.Top(d.vm.OpStack.Len()))
+	case "mem", "memory":
+		from, ok := d.addr(args[1:])
+		if !ok {
+			return
+		}
+		to := from
+		if len(args) > 2 {
+			if to, ok = d.addr(args[2:]); !ok {
+				return
+			}
+		}
+		if from < 0 || to >= len(d.vm.Memory) || from > to {
+			d.printf("invalid memory range\n")
+			return
+		}
+		for a := from; a <= to; a++ {
+			d.printf("%d: %d\n", a, d.vm.Memory[a])
+		}
+	default:
+		d.printf("unknown print target: %s\n", args[0])
+	}
+}
+
+func (d *debugger) stopped(e *vm2.Event, err error) {
+	if err != nil {
+		if errors.Is(err, vm2.ErrHalted) {
+			d.printf("program is not running\n")
+		} else {
+			d.printf("fault: %s\n", err.Error())
+		}
+		return
+	}
+	if e != nil {
+		switch e.Kind {
+		case vm2.EventHalt:
+			d.printf("program halted\n")
+			return
+		case vm2.EventBreakpoint:
+			d.printf("breakpoint\n")
+		case vm2.EventWatchpoint:
+			d.printf("watchpoint: %d changed %d -> %d\n", e.Addr, e.Old, e.New)
+		}
+	}
+	d.printLocation()
+}
+
+func (d *debugger) printLocation() {
+	ip := d.vm.IP()
+	if ip < 0 || ip >= len(d.vm.Memory) {
+		d.printf("%d: out of memory\n", ip)
+		return
+	}
+	d.printf("%d: %s%s\n", ip, vm2.DecodeInstruction(d.vm.Memory, ip), d.source(ip))
+}
+
+// source Source position of the address in parentheses, empty if it is unknown
+func (d *debugger) source(addr int) string {
+	if s := d.vm.SourceMap.Format(addr); s != "" {
+		return " (" + s + ")"
+	}
+	return ""
+}
+
+func (d *debugger) addr(args []string) (int, bool) {
+	if len(args) == 0 {
+		d.printf("address is required\n")
+		return 0, false
+	}
+	addr, err := strconv.Atoi(args[0])
+	if err != nil {
+		d.printf("invalid address: %s\n", args[0])
+		return 0, false
+	}
+	return addr, true
+}
+
+func (d *debugger) printf(format string, a ...any) {
+	_ = d.vm.IO.Flush()
+	_, _ = fmt.Fprintf(d.out, format, a...)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bufio"
+	vm2 "false-vm/vm"
+	"flag"
+	"log"
+	"os"
+)
+
+func disCommand(args []string) {
+	var pf programFlags
+	fs := flag.NewFlagSet("dis", flag.ExitOnError)
+	pf.register(fs)
+	_ = fs.Parse(args)
+
+	prog, err := pf.image()
+	if err != nil {
+		fatal(err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err = vm2.WriteListing(w, prog.Image); err != nil {
+		log.Fatalln("listing writing failed:", err.Error())
+	}
+	if err = w.Flush(); err != nil {
+		log.Fatalln("listing writing failed:", err.Error())
+	}
+}
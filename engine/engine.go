@@ -0,0 +1,248 @@
+// Package engine compiles and runs programs on the VM for embedding false-vm into Go programs
+package engine
+
+import (
+	"bytes"
+	"context"
+	// Built-in languages are registered on init
+	_ "false-vm/arithmetic"
+	_ "false-vm/asm"
+	_ "false-vm/bf"
+	_ "false-vm/false"
+	"false-vm/input"
+	"false-vm/vm"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Default memory sizes (32-bit integers) used when neither options nor image request them
+const (
+	DefaultMemSize       = 131072
+	DefaultOpStackSize   = 1280
+	DefaultCallStackSize = 640
+)
+
+// Program Compiled or loaded bytecode image
+type Program struct {
+	Image *vm.Image
+}
+
+// RunOptions VM setup and execution limits
+type RunOptions struct {
+	// Stdin, Stdout Program input and output, input is empty and output is discarded if nil
+	Stdin  io.Reader
+	Stdout io.Writer
+	// IO Character device used instead of Stdin and Stdout, e.g. vm.TermIO
+	IO vm.IO
+	// MemSize, OpStackSize, CallStackSize Memory sizes (32-bit integers), sizes requested by the image or defaults
+	// are used if zero
+	MemSize       int
+	OpStackSize   int
+	CallStackSize int
+	Arith         vm.ArithMode
+	DivZero       vm.DivZeroMode
+	// MaxInstructions Instructions budget ("fuel"), unlimited when zero
+	MaxInstructions int64
+	// Timeout Maximum execution time, unlimited when zero
+	Timeout time.Duration
+}
+
+// CompileOptions Source language and parser setup of CompileFile
+type CompileOptions struct {
+	// Lang Language name, "auto" or empty detects the language by the shebang-like first line or file extension
+	Lang string
+	// Parser Create parser of the language instead of the default one, e.g. Brainfuck parser of non-default dialect
+	Parser func(l input.Language) (input.Parser, error)
+}
+
+// Compile Compile the source of the language registered in package input with the default parser options,
+// "auto" detects the language by the shebang-like first line
+func Compile(lang string, r io.Reader) (*Program, error) {
+	shebang, r, err := input.ReadShebang(r)
+	if err != nil {
+		return nil, err
+	}
+	l, err := language(lang, input.SourceName(r), shebang)
+	if err != nil {
+		return nil, err
+	}
+	return compile(l.New(), l.Name, r)
+}
+
+// CompileFile Compile the source file, the language is detected by the shebang-like first line or file extension
+// unless it is set by options
+func CompileFile(path string, opts CompileOptions) (*Program, error) {
+	src, err := OpenSource(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	l, err := language(opts.Lang, path, src.Shebang)
+	if err != nil {
+		return nil, err
+	}
+	var p input.Parser
+	if opts.Parser != nil {
+		if p, err = opts.Parser(l); err != nil {
+			return nil, err
+		}
+	} else {
+		p = l.New()
+	}
+	return compile(p, l.Name, src)
+}
+
+// CompileWith Compile the source by the parser, e.g. Brainfuck parser of non-default dialect,
+// parsing errors are returned as *input.Error
+func CompileWith(p input.Parser, lang string, r io.Reader) (*Program, error) {
+	_, r, err := input.ReadShebang(r)
+	if err != nil {
+		return nil, err
+	}
+	return compile(p, lang, r)
+}
+
+// Source Source file opened for parsing, the shebang-like first line is read and replaced by an empty one
+type Source struct {
+	io.Reader
+	// Shebang First line of the file if it starts with #!
+	Shebang string
+	file    *os.File
+}
+
+// OpenSource Open the source file for parsing
+func OpenSource(path string) (*Source, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file: %w", err)
+	}
+	shebang, r, err := input.ReadShebang(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("unable to read file: %w", err)
+	}
+	return &Source{Reader: r, Shebang: shebang, file: file}, nil
+}
+
+// Name Source file name, see input.SourceName
+func (s *Source) Name() string {
+	return s.file.Name()
+}
+
+func (s *Source) Close() error {
+	return s.file.Close()
+}
+
+// language Language by name, "auto" or empty detects it by the file name and shebang-like line
+func language(lang string, file string, shebang string) (input.Language, error) {
+	if lang == "" || lang == "auto" {
+		return input.DetectLanguage(file, shebang)
+	}
+	return input.LookupLanguage(lang)
+}
+
+// compile Compile the source with the shebang-like line already skipped
+func compile(p input.Parser, lang string, r io.Reader) (*Program, error) {
+	w := new(bytes.Buffer)
+	if err := p.Parse(r, w); err != nil {
+		return nil, err
+	}
+	img, err := vm.DecodeImage(w.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	img.Lang = lang
+	if name := input.SourceName(r); name != "" && img.SourceMap != nil {
+		img.SourceMap.File = name
+	}
+	return &Program{Image: img}, nil
+}
+
+// Load Load bytecode (container or headerless)
+func Load(bc []byte) (*Program, error) {
+	img, err := vm.DecodeImage(bc)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{Image: img}, nil
+}
+
+// Optimize Optimize the program code, see vm.Optimize for levels
+func (p *Program) Optimize(level int) error {
+	img, err := vm.Optimize(p.Image, level)
+	if err != nil {
+		return fmt.Errorf("optimization failed: %w", err)
+	}
+	p.Image = img
+	return nil
+}
+
+// Encode Bytecode container of the program
+func (p *Program) Encode() []byte {
+	return p.Image.Encode()
+}
+
+// NewVM Create VM with the program loaded
+func (p *Program) NewVM(opts RunOptions) (*vm.VM, error) {
+	mem := size(opts.MemSize, p.Image.MemSize, DefaultMemSize)
+	opStack := size(opts.OpStackSize, p.Image.OpStackSize, DefaultOpStackSize)
+	callStack := size(opts.CallStackSize, p.Image.CallStackSize, DefaultCallStackSize)
+	// Sizes may come from different sources, so stacks are checked to fit in memory after the code
+	if opStack+callStack >= mem {
+		return nil, fmt.Errorf("op stack (%d) and call stack (%d) do not fit in memory (%d)", opStack, callStack, mem)
+	}
+	if free := mem - opStack - callStack; len(p.Image.Code) > free {
+		return nil, fmt.Errorf("program code (%d) does not fit in memory (%d) below op stack (%d) and call stack (%d)",
+			len(p.Image.Code), mem, opStack, callStack)
+	}
+	v := vm.NewVM(mem, opStack, callStack)
+	v.Arith = opts.Arith
+	v.DivZero = opts.DivZero
+	v.IO = opts.IO
+	if v.IO == nil {
+		in, out := opts.Stdin, opts.Stdout
+		if in == nil {
+			in = strings.NewReader("")
+		}
+		if out == nil {
+			out = io.Discard
+		}
+		v.IO = vm.NewStreamIO(in, out)
+	}
+	if err := v.LoadImage(p.Image); err != nil {
+		return nil, fmt.Errorf("image loading failed: %w", err)
+	}
+	return v, nil
+}
+
+// Run Run the program on the new VM until its end, a fault, context cancellation or limits exhaustion
+func (p *Program) Run(ctx context.Context, opts RunOptions) error {
+	v, err := p.NewVM(opts)
+	if err != nil {
+		return err
+	}
+	return v.RunContext(ctx, opts.Limits())
+}
+
+// Limits Execution limits for vm.VM.RunContext, the timeout counts from now
+func (o RunOptions) Limits() vm.RunOptions {
+	l := vm.RunOptions{MaxInstructions: o.MaxInstructions}
+	if o.Timeout > 0 {
+		l.Deadline = time.Now().Add(o.Timeout)
+	}
+	return l
+}
+
+// size Size of options has priority over the size requested by image
+func size(value int, requested int, def int) int {
+	if value > 0 {
+		return value
+	}
+	if requested > 0 {
+		return requested
+	}
+	return def
+}
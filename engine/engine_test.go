@@ -0,0 +1,222 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"false-vm/input"
+	"false-vm/vm"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompile_Run(t *testing.T) {
+	tests := []struct {
+		name  string
+		lang  string
+		src   string
+		stdin string
+		want  string
+	}{
+		{
+			name: "check false",
+			lang: "false",
+			src:  `"6*7=" 6 7*.`,
+			want: "6*7=42",
+		},
+		{
+			name:  "check bf",
+			lang:  "bf",
+			src:   ",+.",
+			stdin: "a",
+			want:  "b",
+		},
+		{
+			name: "check arithmetic",
+			lang: "arithmetic",
+			src:  "let x = 6\nx * 7",
+			want: "42\n",
+		},
+		{
+			name: "check asm",
+			lang: "asm",
+			src:  "Push 42\nWriteInt\nEnd",
+			want: "42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := Compile(tt.lang, strings.NewReader(tt.src))
+			if err != nil {
+				t.Fatalf("Compile() error = %v", err)
+			}
+			if prog.Image.Lang != tt.lang {
+				t.Errorf("Compile() language = %q, want %q", prog.Image.Lang, tt.lang)
+			}
+			out := new(bytes.Buffer)
+			opts := RunOptions{Stdin: strings.NewReader(tt.stdin), Stdout: out}
+			if err = prog.Run(context.Background(), opts); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("Run() output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompile_Errors(t *testing.T) {
+	if _, err := Compile("cobol", strings.NewReader("")); err == nil {
+		t.Errorf("Compile() of unknown language error = nil")
+	}
+	_, err := Compile("false", strings.NewReader("1 ]"))
+	var ce *input.Error
+	if !errors.As(err, &ce) || len(ce.Diagnostics) != 1 {
+		t.Errorf("Compile() error = %v, want *input.Error with 1 diagnostic", err)
+	}
+}
+
+func TestProgram_NewVM(t *testing.T) {
+	prog, err := Compile("false", strings.NewReader("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog.Image.MemSize = 8192
+	prog.Image.OpStackSize = 100
+
+	// Options have priority over the image, image over defaults
+	v, err := prog.NewVM(RunOptions{MemSize: 4096})
+	if err != nil {
+		t.Fatalf("NewVM() error = %v", err)
+	}
+	if len(v.Memory) != 4096 || v.OpStack.Size != 100 || v.CallStack.Size != DefaultCallStackSize {
+		t.Errorf("NewVM() sizes = %d, %d, %d, want 4096, 100, %d",
+			len(v.Memory), v.OpStack.Size, v.CallStack.Size, DefaultCallStackSize)
+	}
+
+	loaded, err := Load(prog.Encode())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if loaded.Image.MemSize != 8192 || loaded.Image.Lang != "false" {
+		t.Errorf("Load() image = %+v", loaded.Image)
+	}
+}
+
+func TestProgram_NewVMSizes(t *testing.T) {
+	prog, err := Compile("false", strings.NewReader(`"hello"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		opts    RunOptions
+		wantErr bool
+	}{
+		{name: "check default stacks in small memory", opts: RunOptions{MemSize: 1000}, wantErr: true},
+		{name: "check stacks fill memory", opts: RunOptions{MemSize: 100, OpStackSize: 50, CallStackSize: 50}, wantErr: true},
+		{name: "check stacks overlap code", opts: RunOptions{MemSize: 100, OpStackSize: 49, CallStackSize: 49}, wantErr: true},
+		{name: "check stacks fit", opts: RunOptions{MemSize: 1000, OpStackSize: 100, CallStackSize: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := prog.Run(context.Background(), tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProgram_RunLimits(t *testing.T) {
+	prog, err := Compile("false", strings.NewReader("[1][]#"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var be *vm.BudgetError
+	err = prog.Run(context.Background(), RunOptions{MaxInstructions: 1000})
+	if !errors.As(err, &be) || be.Budget != vm.BudgetInstructions {
+		t.Errorf("Run() with fuel error = %v, want instructions budget error", err)
+	}
+	err = prog.Run(context.Background(), RunOptions{Timeout: 1})
+	if !errors.As(err, &be) || be.Budget != vm.BudgetTime {
+		t.Errorf("Run() with timeout error = %v, want time budget error", err)
+	}
+}
+
+func TestCompile_Shebang(t *testing.T) {
+	// Shebang line is not compiled and positions of the rest are kept
+	src := "#!/usr/bin/env false-vm -l brainfuck\n++++++++[>++++++++<-]>+.\n]"
+	_, err := Compile("auto", strings.NewReader(src))
+	var ce *input.Error
+	if !errors.As(err, &ce) || ce.Diagnostics[0].Line != 3 || ce.Diagnostics[0].Col != 1 {
+		t.Fatalf("Compile() error = %v, want unbalanced ] at 3:1", err)
+	}
+
+	prog, err := Compile("auto", strings.NewReader(src[:len(src)-2]))
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	if prog.Image.Lang != "bf" {
+		t.Errorf("Compile() language = %q, want bf", prog.Image.Lang)
+	}
+	out := new(bytes.Buffer)
+	if err = prog.Run(context.Background(), RunOptions{Stdout: out}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if out.String() != "A" {
+		t.Errorf("Run() output = %q, want %q", out.String(), "A")
+	}
+}
+
+func TestCompileFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "prog.f")
+	if err := os.WriteFile(path, []byte("#!/usr/bin/env false-vm -l bf\n1 2+."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		opts CompileOptions
+		want string
+	}{
+		{
+			name: "check language by shebang",
+			want: "bf",
+		},
+		{
+			name: "check language override",
+			opts: CompileOptions{Lang: "false"},
+			want: "false",
+		},
+		{
+			name: "check parser override",
+			opts: CompileOptions{Parser: func(l input.Language) (input.Parser, error) {
+				if l.Name != "bf" {
+					t.Errorf("Parser() language = %q, want bf", l.Name)
+				}
+				return l.New(), nil
+			}},
+			want: "bf",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := CompileFile(path, tt.opts)
+			if err != nil {
+				t.Fatalf("CompileFile() error = %v", err)
+			}
+			if prog.Image.Lang != tt.want {
+				t.Errorf("CompileFile() language = %q, want %q", prog.Image.Lang, tt.want)
+			}
+			if prog.Image.SourceMap.File != path {
+				t.Errorf("CompileFile() source file = %q, want %q", prog.Image.SourceMap.File, path)
+			}
+		})
+	}
+	if _, err := CompileFile(filepath.Join(dir, "missing.f"), CompileOptions{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CompileFile() of missing file error = %v, want not exist", err)
+	}
+}
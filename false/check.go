@@ -0,0 +1,340 @@
+package false
+
+import (
+	"false-vm/input"
+	"false-vm/vm"
+	"io"
+)
+
+type nodeKind int
+
+const (
+	// nodeCommand Command of InstrMap
+	nodeCommand nodeKind = iota
+	// nodePush Integer or char constant
+	nodePush
+	nodeVar
+	nodeLambda
+	nodeCall
+	nodeIf
+	nodeWhile
+	// nodeString String is written, stack is unchanged
+	nodeString
+	// nodeInline Inline bytecode with unknown stack effect
+	nodeInline
+)
+
+// node Item of the program being checked
+type node struct {
+	kind nodeKind
+	cmd  rune
+	// v, mode Variable index and its store or fetch mode
+	v    int
+	mode rune
+	fn   *lambda
+	pos
+}
+
+// effect Stack effect: number of items taken from the stack and put back
+type effect struct {
+	in  int
+	out int
+}
+
+// then Effect of e followed by n
+func (e effect) then(n effect) effect {
+	if n.in > e.out {
+		return effect{in: e.in + n.in - e.out, out: n.out}
+	}
+	return effect{in: e.in, out: e.out - n.in + n.out}
+}
+
+// cmdEffect Stack effect of the command from effects of its instructions
+func cmdEffect(cmd rune) effect {
+	e := effect{}
+	for _, i := range InstrMap[cmd] {
+		info := vm.Instructions[i]
+		e = e.then(effect{in: info.Pop, out: info.Push})
+	}
+	return e
+}
+
+// lambda Lambda with its effect inferred on the first call
+type lambda struct {
+	body []node
+	pos
+	effect effect
+	// known Effect is inferred, it is unknown for lambdas calling unknown code
+	known bool
+	state int
+}
+
+const (
+	lambdaNew = iota
+	lambdaChecking
+	lambdaChecked
+)
+
+// frame Abstract stack of the lambda or main program, items are lambdas or nil for other values
+type frame struct {
+	stack []*lambda
+	// need Items taken from below the initial stack
+	need int
+	// lost Stack effect is unknown since the unknown code is called
+	lost bool
+	main bool
+	// underflow Main program underflow is reported only once
+	underflow bool
+}
+
+// checker Stack effect checker, variables hold lambdas assigned to them anywhere in the program
+type checker struct {
+	diags   *input.Diagnostics
+	vars    [VarsCount]*lambda
+	lambdas []*lambda
+	seen    map[input.Diagnostic]bool
+}
+
+// Check Infer stack effects of the FALSE program and warn about lambdas with stack effect inconsistent across
+// branches and main program underflow, parsing errors are returned as *input.Error
+func Check(r io.Reader) ([]input.Diagnostic, error) {
+	diags := input.NewDiagnostics(input.SourceName(r), "")
+	in := input.NewReaderInput(r, diags)
+	ti := TokenInput{Input: in}
+	c := &checker{diags: diags, seen: make(map[input.Diagnostic]bool)}
+	prog := c.scan(&ti)
+	if err := in.Err(); err != nil {
+		return nil, err
+	}
+	if err := diags.Err(); err != nil {
+		return nil, err
+	}
+
+	c.run(prog, true)
+	// Lambdas which are never called directly are checked on their own
+	for _, l := range c.lambdas {
+		c.lambdaEffect(l)
+	}
+	return diags.List, nil
+}
+
+// scan Read program nodes up to the end of the lambda or the source
+func (c *checker) scan(ti *TokenInput) []node {
+	nodes := make([]node, 0)
+	var open []*lambda
+	var stack [][]node
+	add := func(n node) {
+		nodes = append(nodes, n)
+	}
+	for {
+		t, ok := ti.ReadToken(c.diags)
+		if !ok {
+			continue
+		}
+		if t.kind == tokEOF {
+			break
+		}
+		switch t.kind {
+		case tokPush:
+			add(node{kind: nodePush, pos: t.pos})
+		case tokInline:
+			add(node{kind: nodeInline, pos: t.pos})
+		case tokVar:
+			add(node{kind: nodeVar, v: t.value, mode: t.mode, pos: t.pos})
+		case tokSubStart:
+			open = append(open, &lambda{pos: t.pos})
+			stack = append(stack, nodes)
+			nodes = make([]node, 0)
+		case tokSubEnd:
+			if len(open) == 0 {
+				c.diags.Errorf(t.line, t.col, "unbalanced ]: lambda end without start")
+				continue
+			}
+			l := open[len(open)-1]
+			open = open[:len(open)-1]
+			l.body = nodes
+			c.lambdas = append(c.lambdas, l)
+			nodes = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			add(node{kind: nodeLambda, fn: l, pos: l.pos})
+		case tokCall:
+			add(node{kind: nodeCall, pos: t.pos})
+		case tokIf:
+			add(node{kind: nodeIf, pos: t.pos})
+		case tokWhile:
+			add(node{kind: nodeWhile, pos: t.pos})
+		case tokCommand:
+			add(node{kind: nodeCommand, cmd: t.cmd, pos: t.pos})
+		case tokString:
+			add(node{kind: nodeString, pos: t.pos})
+		}
+	}
+	for _, l := range open {
+		c.diags.Errorf(l.line, l.col, "unbalanced [: lambda is not closed")
+	}
+	return nodes
+}
+
+func (c *checker) warnf(p pos, format string, args ...any) {
+	n := len(c.diags.List)
+	c.diags.Warnf(p.line, p.col, format, args...)
+	// Lambdas are checked again while their recursive effect is inferred, so the same warning is reported once
+	if d := c.diags.List[n]; c.seen[d] {
+		c.diags.List = c.diags.List[:n]
+	} else {
+		c.seen[d] = true
+	}
+}
+
+// lambdaEffect Infer the lambda effect, recursive call gets the effect inferred so far
+func (c *checker) lambdaEffect(l *lambda) (effect, bool) {
+	if l.state != lambdaNew {
+		return l.effect, l.known
+	}
+	l.state = lambdaChecking
+	for i := 0; i < 4; i++ {
+		f := c.run(l.body, false)
+		e, known := effect{in: f.need, out: len(f.stack)}, !f.lost
+		if e == l.effect && known == l.known {
+			break
+		}
+		l.effect, l.known = e, known
+	}
+	l.state = lambdaChecked
+	return l.effect, l.known
+}
+
+// run Run the nodes on the abstract stack
+func (c *checker) run(nodes []node, main bool) *frame {
+	f := &frame{main: main}
+	for _, n := range nodes {
+		if f.lost {
+			break
+		}
+		switch n.kind {
+		case nodeCommand:
+			f.apply(c, n, cmdEffect(n.cmd))
+		case nodePush:
+			f.push(nil)
+		case nodeString:
+		case nodeInline:
+			f.lost = true
+		case nodeLambda:
+			f.push(n.fn)
+		case nodeVar:
+			switch n.mode {
+			case STORE_VAR:
+				f.take(c, n, 1)
+				c.vars[n.v] = f.pop()
+			case FETCH_VAR:
+				f.push(c.vars[n.v])
+			default:
+				f.push(nil)
+			}
+		case nodeCall:
+			f.take(c, n, 1)
+			fn := f.pop()
+			if fn == nil {
+				f.lost = true
+				break
+			}
+			e, known := c.lambdaEffect(fn)
+			if !known {
+				f.lost = true
+				break
+			}
+			f.apply(c, n, e)
+		case nodeIf:
+			f.take(c, n, 2)
+			body := f.pop()
+			f.pop()
+			if body == nil {
+				f.lost = true
+				break
+			}
+			e, known := c.lambdaEffect(body)
+			if !known {
+				// Unknown (recursive) body is expected to keep the stack depth
+				break
+			}
+			if d := e.out - e.in; d != 0 {
+				c.warnf(n.pos, "if body changes stack depth by %+d, so the stack differs whether the condition is true or not", d)
+			}
+			f.apply(c, n, effect{in: e.in, out: e.in})
+		case nodeWhile:
+			f.take(c, n, 2)
+			body, cond := f.pop(), f.pop()
+			if body == nil || cond == nil {
+				f.lost = true
+				break
+			}
+			ce, cknown := c.lambdaEffect(cond)
+			be, bknown := c.lambdaEffect(body)
+			need := 0
+			if cknown {
+				if d := ce.out - ce.in; d != 1 {
+					c.warnf(n.pos, "while condition changes stack depth by %+d, but it should leave only the flag", d)
+				}
+				need = max(need, ce.in)
+			}
+			if bknown {
+				if d := be.out - be.in; d != 0 {
+					c.warnf(n.pos, "while body changes stack depth by %+d on every iteration", d)
+				}
+				need = max(need, be.in)
+			}
+			f.apply(c, n, effect{in: need, out: need})
+		}
+	}
+	return f
+}
+
+func (f *frame) push(l *lambda) {
+	f.stack = append(f.stack, l)
+}
+
+// pop Take the top item, items below the initial stack are not known
+func (f *frame) pop() *lambda {
+	if len(f.stack) == 0 {
+		f.need++
+		return nil
+	}
+	l := f.stack[len(f.stack)-1]
+	f.stack = f.stack[:len(f.stack)-1]
+	return l
+}
+
+// take Check the node can take n items, only main program stack is known to be empty at start
+func (f *frame) take(c *checker, n node, count int) {
+	if f.main && !f.underflow && count > len(f.stack) {
+		f.underflow = true
+		c.warnf(n.pos, "stack underflow: %s takes %d item(s), but the stack has %d", n.name(), count, len(f.stack))
+	}
+}
+
+func (f *frame) apply(c *checker, n node, e effect) {
+	f.take(c, n, e.in)
+	for i := 0; i < e.in; i++ {
+		f.pop()
+	}
+	for i := 0; i < e.out; i++ {
+		f.push(nil)
+	}
+}
+
+// name Source spelling of the node for messages
+func (n node) name() string {
+	switch n.kind {
+	case nodeCommand:
+		return "'" + string(n.cmd) + "'"
+	case nodeVar:
+		return "'" + string(rune('a'+n.v)) + string(n.mode) + "'"
+	case nodeCall:
+		return "'!'"
+	case nodeIf:
+		return "'?'"
+	case nodeWhile:
+		return "'#'"
+	}
+	return "command"
+}
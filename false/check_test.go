@@ -0,0 +1,73 @@
+package false
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "check recursive factorial is consistent",
+			src:  `[$1=$[\%1\]?~[$1-f;!*]?]f: 6f;!.`,
+		},
+		{
+			name: "check while loop is consistent",
+			src:  `5[$][$.1-]#%`,
+		},
+		{
+			name: "check main program underflow",
+			src:  `1 2+ +.`,
+			want: []string{"1:6: warning: stack underflow: '+' takes 2 item(s), but the stack has 1"},
+		},
+		{
+			name: "check underflow by lambda call",
+			src:  `[+]a: 1 a;!`,
+			want: []string{"1:11: warning: stack underflow: '!' takes 2 item(s), but the stack has 1"},
+		},
+		{
+			name: "check inconsistent if body",
+			src:  `1 1 1=[1 2]?.`,
+			want: []string{"1:12: warning: if body changes stack depth by +2, so the stack differs whether the condition is true or not"},
+		},
+		{
+			name: "check inconsistent while",
+			src:  `1[$ $][%]#`,
+			want: []string{
+				"1:10: warning: while condition changes stack depth by +2, but it should leave only the flag",
+				"1:10: warning: while body changes stack depth by -1 on every iteration",
+			},
+		},
+		{
+			name: "check lambda which is never called",
+			src:  `[1[2]?]`,
+			want: []string{"1:6: warning: if body changes stack depth by +1, so the stack differs whether the condition is true or not"},
+		},
+		{
+			name:    "check parsing error",
+			src:     `[1 2+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warns, err := Check(strings.NewReader(tt.src))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, w := range warns {
+				got = append(got, w.Error())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package false
+
+import (
+	"bytes"
+	"false-vm/vm"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestParser_Conformance Classic FALSE programs and FALSE 1.2 spec features
+func TestParser_Conformance(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "check hello world",
+			src:  `"Hello, World!"`,
+			want: "Hello, World!",
+		},
+		{
+			name: "check factorial",
+			src:  `[$1=$[\%1\]?~[$1-f;!*]?]f: 6f;!.`,
+			want: "720",
+		},
+		{
+			name: "check recursive fibonacci",
+			src:  `[$1>[1-$f;!\1-f;!+]?]f: 10f;!.`,
+			want: "55",
+		},
+		{
+			name: "check primes",
+			src:  `30 9[1-$][\$@$@$@$@\/*=[1-$$[%\1-$@]?0=[\$.' ,\]?]?]#`,
+			want: "29 23 19 17 13 11 7 5 3 2 ",
+		},
+		{
+			name: "check countdown",
+			src:  `5[$][$.1-]#%`,
+			want: "54321",
+		},
+		{
+			name: "check copy input to output",
+			src:  `[^$1_=~][,]#%`,
+			in:   "copy",
+			want: "copy",
+		},
+		{
+			name: "check true is all bits set",
+			src:  `1 1=." "2 1>." "0~." "1 2=.`,
+			want: "-1 -1 -1 0",
+		},
+		{
+			name: "check bitwise and or",
+			src:  `12 10&." "12 10|." "5~.`,
+			want: "8 14 -6",
+		},
+		{
+			name: "check comments",
+			src:  "{ comment [ \" } 1{}2+. { multi\nline }",
+			want: "3",
+		},
+		{
+			name: "check empty string",
+			src:  `""1.`,
+			want: "1",
+		},
+		{
+			name: "check backslash in string is literal",
+			src:  `"a\b"`,
+			want: `a\b`,
+		},
+		{
+			name: "check string of backslash",
+			src:  `"\"1.`,
+			want: `\1`,
+		},
+		{
+			name: "check pick",
+			src:  `1 2 3 1ø. 2O.`,
+			want: "21",
+		},
+		{
+			name: "check ISO-8859-1 pick",
+			src:  "1 2 1\xf8.",
+			want: "1",
+		},
+		{
+			name: "check flush",
+			src:  `"a"ß"b"B`,
+			want: "ab",
+		},
+		{
+			name: "check inline bytecode",
+			src:  "65 " + strconv.Itoa(vm.InstrWriteInt) + "`",
+			want: "65",
+		},
+		{
+			name:    "check comment is not closed",
+			src:     `1. { comment`,
+			wantErr: true,
+		},
+		{
+			name:    "check unknown command",
+			src:     `1X.`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := new(bytes.Buffer)
+			err := NewParser().Parse(strings.NewReader(tt.src), w)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			img, err := vm.DecodeImage(w.Bytes())
+			if err != nil {
+				t.Fatalf("DecodeImage() error = %v", err)
+			}
+			out := new(bytes.Buffer)
+			v := vm.NewVM(4096, 256, 256)
+			v.IO = vm.NewStreamIO(strings.NewReader(tt.in), out)
+			if err = v.LoadImage(img); err != nil {
+				t.Fatalf("LoadImage() error = %v", err)
+			}
+			if err = v.Run(); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("Run() output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package false
 
 import (
-	"errors"
 	"false-vm/input"
 	"false-vm/vm"
 	"io"
@@ -10,92 +9,196 @@ import (
 type Parser struct {
 }
 
-var InstrMap = map[rune]int{
-	DUP:        vm.InstrDup,
-	DROP:       vm.InstrDrop,
-	SWAP:       vm.InstrSwap,
-	ROT:        vm.InstrRot,
-	PICK:       vm.InstrPick,
-	PLUS:       vm.InstrPlus,
-	MINUS:      vm.InstrMinus,
-	MULTIPLY:   vm.InstrMultiply,
-	DIVIDE:     vm.InstrDivide,
-	NEGATIVE:   vm.InstrNegative,
-	AND:        vm.InstrAnd,
-	OR:         vm.InstrOr,
-	NOT:        vm.InstrNot,
-	GREATER:    vm.InstrMore,
-	EQUALS:     vm.InstrEquals,
-	READ_CHAR:  vm.InstrReadChar,
-	WRITE_CHAR: vm.InstrWriteChar,
-	WRITE_INT:  vm.InstrWriteInt,
-	FLUSH:      vm.InstrFlush,
+// InstrMap Instructions of every command, FALSE true is -1 (all bits set), so comparisons negate VM 1
+// and logic operators are bitwise
+var InstrMap = map[rune][]int{
+	DUP:        {vm.InstrDup},
+	DROP:       {vm.InstrDrop},
+	SWAP:       {vm.InstrSwap},
+	ROT:        {vm.InstrRot},
+	PICK:       {vm.InstrPick},
+	PICK_ALT:   {vm.InstrPick},
+	PLUS:       {vm.InstrPlus},
+	MINUS:      {vm.InstrMinus},
+	MULTIPLY:   {vm.InstrMultiply},
+	DIVIDE:     {vm.InstrDivide},
+	NEGATIVE:   {vm.InstrNegative},
+	AND:        {vm.InstrBitAnd},
+	OR:         {vm.InstrBitOr},
+	NOT:        {vm.InstrBitNot},
+	GREATER:    {vm.InstrMore, vm.InstrNegative},
+	EQUALS:     {vm.InstrEquals, vm.InstrNegative},
+	READ_CHAR:  {vm.InstrReadChar},
+	WRITE_CHAR: {vm.InstrWriteChar},
+	WRITE_INT:  {vm.InstrWriteInt},
+	FLUSH:      {vm.InstrFlush},
+	FLUSH_ALT:  {vm.InstrFlush},
+	STORE_VAR:  {vm.InstrStoreI},
+	FETCH_VAR:  {vm.InstrFetchI},
 }
 
+// pos Source position
+type pos struct {
+	line int
+	col  int
+}
+
+// VarsCount Variables a-z are contiguous memory cells placed after the program, memory after them is free for arrays
+const VarsCount = 'z' - 'a' + 1
+
 func NewParser() *Parser {
 	return &Parser{}
 }
 
+func init() {
+	input.Register(input.Language{
+		Name:       "false",
+		Aliases:    []string{"f"},
+		Extensions: []string{".false", ".f"},
+		New:        func() input.Parser { return NewParser() },
+	})
+}
+
+// compiler FALSE code generator
+type compiler struct {
+	bc   *vm.BytecodeWriter
+	vars [VarsCount]vm.Label
+	used [VarsCount]bool
+	// varsAddr Address of the variable cells out of the code, cells are placed after the program if it is negative
+	varsAddr int
+}
+
+func newCompiler(varsAddr int) *compiler {
+	c := &compiler{bc: vm.NewBytecodeWriter(), varsAddr: varsAddr}
+	for i := range c.vars {
+		c.vars[i] = c.bc.NewLabel()
+	}
+	return c
+}
+
 func (p *Parser) Parse(r io.Reader, w io.Writer) error {
-	data, err := io.ReadAll(r)
-	if err != nil {
+	c := newCompiler(-1)
+	if err := c.compile(r); err != nil {
 		return err
 	}
-	ti := TokenInput{Input: &input.StringInput{Str: string(data)}}
+	bc := c.bc
+	bc.WriteEnd()
+	// Cells are written up to the last used variable, the rest are free memory after the program
+	last := -1
+	for i, u := range c.used {
+		if u {
+			last = i
+		}
+	}
+	for i := 0; i <= last; i++ {
+		bc.Bind(c.vars[i])
+		if c.used[i] {
+			bc.AddSymbol(bc.Len(), string(rune('a'+i)))
+		}
+		bc.WriteInt(0)
+	}
+	_, err := bc.WriteTo(w)
+	return err
+}
 
-	bc := vm.NewBytecodeWriter()
+// CompileFragment Compile the source to code running at the base address with variables a-z in the cells starting
+// from varsAddr, so fragments compiled one after another share variables and lambdas (used by REPL)
+func CompileFragment(r io.Reader, base int, varsAddr int) (*vm.Image, error) {
+	c := newCompiler(varsAddr)
+	if err := c.compile(r); err != nil {
+		return nil, err
+	}
+	c.bc.WriteEnd()
+	img, err := c.bc.Image()
+	if err != nil {
+		return nil, err
+	}
+	img.Lang = "false"
+	img.Relocate(base)
+	for i, u := range c.used {
+		if u {
+			if img.Symbols == nil {
+				img.Symbols = make(map[int]string)
+			}
+			img.Symbols[varsAddr+i] = string(rune('a' + i))
+		}
+	}
+	return img, nil
+}
 
-	vars := make(map[string]int)
+// Incomplete Check the source ends inside a lambda, string or comment, so REPL reads more lines
+func Incomplete(src string) bool {
+	ti := TokenInput{Input: &input.StringInput{Str: src, Diags: input.NewDiagnostics("", src)}}
+	depth := 0
 	for !ti.Eof() {
-		if ti.IsInt() {
-			if v, err := ti.ReadInt(); err == nil {
-				bc.WritePush(v)
-			} else {
-				return err
-			}
-		} else if ti.IsCharCode() {
-			if v, err := ti.ReadCharCode(); err == nil {
-				bc.WritePush(int(v))
-			} else {
-				return err
+		switch {
+		case ti.IsCharCode():
+			_, _ = ti.ReadCharCode()
+		case ti.IsString():
+			if _, err := ti.ReadString(); err != nil {
+				return true
 			}
-		} else if ti.IsVar() {
-			if v, m, err := ti.ReadVar(); err == nil {
-				var addr int
-				ok := false
-				if addr, ok = vars[v]; !ok {
-					// New variable
-					addr = bc.WriteVar(0)
-					vars[v] = addr
-				}
-				switch m {
-				case STORE_VAR:
-					bc.WriteStore(addr)
-					break
-				case FETCH_VAR:
-					bc.WriteFetch(addr)
-					break
-				}
-			} else {
-				return err
+		case ti.IsCommentStart():
+			if _, err := ti.ReadComment(); err != nil {
+				return true
 			}
-		} else if ti.IsSubStart() {
+		case ti.IsSubStart():
 			ti.SkipSubStart()
-			bc.SubCreate()
-		} else if ti.IsSubEnd() {
+			depth++
+		case ti.IsSubEnd():
 			ti.SkipSubEnd()
+			depth--
+		default:
+			ti.Input.Next()
+		}
+	}
+	return depth > 0
+}
+
+// compile Compile the source to the code, errors are returned as *input.Error
+func (c *compiler) compile(r io.Reader) error {
+	diags := input.NewDiagnostics(input.SourceName(r), "")
+	in := input.NewReaderInput(r, diags)
+	ti := TokenInput{Input: in}
+	bc := c.bc
+	// subs Positions of the open lambdas
+	var subs []pos
+
+	// Errors are reported to diags and parsing goes on to find all of them
+	for {
+		t, ok := ti.ReadToken(diags)
+		if !ok {
+			continue
+		}
+		if t.kind == tokEOF {
+			break
+		}
+		bc.SetSourcePos(t.line, t.col)
+		switch t.kind {
+		case tokPush:
+			bc.WritePush(t.value)
+		case tokInline:
+			// Inline word is recorded as instruction, so the optimizer decodes it as code
+			bc.WriteCommand(t.value)
+		case tokVar:
+			c.writeVar(t.value, t.mode)
+		case tokSubStart:
+			subs = append(subs, t.pos)
+			bc.SubCreate()
+		case tokSubEnd:
+			if len(subs) == 0 {
+				diags.Errorf(t.line, t.col, "unbalanced ]: lambda end without start")
+				continue
+			}
+			subs = subs[:len(subs)-1]
 			if err := bc.SubReturn(); err != nil {
-				ti.Input.Croak(err.Error())
 				return err
 			}
-		} else if ti.IsSubCall() {
-			ti.SkipSubCall()
+		case tokCall:
 			bc.WriteCall()
-		} else if ti.IsIf() {
-			ti.SkipIf()
+		case tokIf:
 			bc.WriteCallIf()
-		} else if ti.IsWhile() {
-			ti.SkipWhile()
+		case tokWhile:
 			// Reserved condition and body addresses
 			ca := bc.WriteVar(0)
 			ba := bc.WriteVar(0)
@@ -114,38 +217,51 @@ func (p *Parser) Parse(r io.Reader, w io.Writer) error {
 			bc.WriteFetch(ca)
 			bc.WriteCall()
 			// Push to stack call body address
-			bc.WritePush(bca)
+			bc.WritePushAddr(bca)
 			// Call condition
 			bc.WriteGotoIf()
-		} else if ti.IsCommand() {
-			if ic, err := ti.ReadCommand(); err == nil {
-				if cmd, ok := InstrMap[ic]; ok {
-					bc.WriteCommand(cmd)
-				} else {
-					err := errors.New("invalid command")
-					ti.Input.Croak(err.Error())
-					return err
-				}
-			} else {
-				return err
-			}
-		} else if ti.IsString() {
-			if s, err := ti.ReadString(); err == nil {
-				bc.WriteString(s)
-			} else {
-				ti.Input.Croak(err.Error())
-				return err
-			}
-		} else if ti.IsCommentStart() {
-			if _, err := ti.ReadComment(); err != nil {
-				ti.Input.Croak(err.Error())
-				return err
+		case tokCommand:
+			for _, cmd := range InstrMap[t.cmd] {
+				bc.WriteCommand(cmd)
 			}
-		} else if ti.IsWhitespace() {
-			ti.SkipWhitespace()
+		case tokString:
+			bc.WriteString(t.text)
 		}
 	}
-	bc.WriteEnd()
-	_, err = bc.WriteTo(w)
-	return err
+	if err := in.Err(); err != nil {
+		return err
+	}
+	for _, sp := range subs {
+		diags.Errorf(sp.line, sp.col, "unbalanced [: lambda is not closed")
+	}
+	return diags.Err()
+}
+
+// writeVar Write reference to the variable of the mode: store, fetch or push its address
+func (c *compiler) writeVar(v int, mode rune) {
+	bc := c.bc
+	c.used[v] = true
+	if c.varsAddr >= 0 {
+		// Cells are out of the code, so their addresses are not relocated
+		addr := c.varsAddr + v
+		switch mode {
+		case STORE_VAR:
+			bc.WriteCommand(vm.InstrStore)
+		case FETCH_VAR:
+			bc.WriteCommand(vm.InstrFetch)
+		default:
+			bc.WriteCommand(vm.InstrPush)
+		}
+		bc.WriteInt(addr)
+		return
+	}
+	l := c.vars[v]
+	switch mode {
+	case STORE_VAR:
+		bc.WriteStoreLabel(l)
+	case FETCH_VAR:
+		bc.WriteFetchLabel(l)
+	default:
+		bc.WritePushLabel(l)
+	}
 }
@@ -1,8 +1,10 @@
 package false
 
 import (
+	"bytes"
 	"false-vm/vm"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -26,18 +28,101 @@ func TestParser_Parse(t *testing.T) {
 			want:    []int{1, 1, 1, 2, vm.InstrSwap, vm.InstrPlus, vm.InstrWriteInt, vm.InstrEnd},
 			wantErr: false,
 		},
+		{
+			name: "check variables are placed after the program",
+			args: struct {
+				str string
+			}{
+				str: "1b:b;.",
+			},
+			want: []int{
+				vm.InstrPush, 1, vm.InstrStore, 9, vm.InstrFetch, 9, vm.InstrWriteInt, vm.InstrEnd,
+				0, 0,
+			},
+			wantErr: false,
+		},
+		{
+			name: "check variable address as array",
+			args: struct {
+				str string
+			}{
+				str: "7a1+:a1+;",
+			},
+			want: []int{
+				vm.InstrPush, 7, vm.InstrPush, 15, vm.InstrPush, 1, vm.InstrPlus, vm.InstrStoreI,
+				vm.InstrPush, 15, vm.InstrPush, 1, vm.InstrPlus, vm.InstrFetchI, vm.InstrEnd,
+				0,
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := &Parser{}
-			got, err := p.Parse(tt.args.str)
+			w := new(bytes.Buffer)
+			err := p.Parse(strings.NewReader(tt.args.str), w)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			img, err := vm.DecodeImage(w.Bytes())
+			if err != nil {
+				t.Errorf("DecodeImage() error = %v", err)
+				return
+			}
+			got := img.Code
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Parse() got = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestCompileFragment(t *testing.T) {
+	v := vm.NewVM(1024, 64, 64)
+	out := new(bytes.Buffer)
+	v.IO = vm.NewStreamIO(strings.NewReader(""), out)
+	vars := 1024 - 64 - 64 - int(VarsCount)
+	base := 0
+	// Fragments share the variables, the lambda of the first one and the op stack
+	for _, src := range []string{"[2*]d: 1 2", "+ 3d;! i:", "i;."} {
+		img, err := CompileFragment(strings.NewReader(src), base, vars)
+		if err != nil {
+			t.Fatalf("CompileFragment(%q) error = %v", src, err)
+		}
+		copy(v.Memory[base:], img.Code)
+		base += len(img.Code)
+		if err = v.SetIP(img.Entry); err != nil {
+			t.Fatal(err)
+		}
+		if err = v.Run(); err != nil {
+			t.Fatalf("Run() of %q error = %v", src, err)
+		}
+	}
+	if got := v.OpStack.Top(2); !reflect.DeepEqual(got, []int{3}) || out.String() != "6" {
+		t.Errorf("stack = %v, output = %q, want [3] and %q", got, out.String(), "6")
+	}
+	if v.Memory[vars+'i'-'a'] != 6 {
+		t.Errorf("variable i = %d, want 6", v.Memory[vars+'i'-'a'])
+	}
+}
+
+func TestIncomplete(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{src: "1 2+.", want: false},
+		{src: "[1 [2]", want: true},
+		{src: "[1]\n", want: false},
+		{src: "\"[ not lambda", want: true},
+		{src: "{ comment [", want: true},
+		{src: "'[ 1", want: false},
+		{src: "]", want: false},
+	}
+	for _, tt := range tests {
+		if got := Incomplete(tt.src); got != tt.want {
+			t.Errorf("Incomplete(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
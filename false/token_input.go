@@ -17,6 +17,8 @@ const (
 	SWAP rune = '\\'
 	ROT  rune = '@'
 	PICK rune = 'ø'
+	// PICK_ALT ASCII spelling of PICK
+	PICK_ALT rune = 'O'
 
 	PLUS     rune = '+'
 	MINUS    rune = '-'
@@ -34,9 +36,14 @@ const (
 	WRITE_CHAR rune = ','
 	WRITE_INT  rune = '.'
 	FLUSH      rune = 'ß'
+	// FLUSH_ALT ASCII spelling of FLUSH
+	FLUSH_ALT rune = 'B'
 
 	STORE_VAR rune = ':'
 	FETCH_VAR rune = ';'
+
+	// INLINE Preceding integer is written to the code as is (inline bytecode)
+	INLINE rune = '`'
 )
 
 func (ti *TokenInput) IsInt() bool {
@@ -58,6 +65,16 @@ func (ti *TokenInput) ReadInt() (int, error) {
 	return v, nil
 }
 
+func (ti *TokenInput) IsInline() bool {
+	return ti.Input.Peek() == INLINE
+}
+
+func (ti *TokenInput) SkipInline() {
+	if ti.IsInline() {
+		ti.Input.Next()
+	}
+}
+
 func (ti *TokenInput) IsCharCode() bool {
 	return ti.Input.Peek() == '\''
 }
@@ -75,10 +92,11 @@ func (ti *TokenInput) ReadCharCode() (rune, error) {
 func (ti *TokenInput) IsCommand() bool {
 	c := ti.Input.Peek()
 	switch c {
-	case DUP, DROP, SWAP, ROT, PICK,
+	case DUP, DROP, SWAP, ROT, PICK, PICK_ALT,
 		PLUS, MINUS, MULTIPLY, DIVIDE, NEGATIVE, AND, OR, NOT,
 		GREATER, EQUALS,
-		READ_CHAR, WRITE_CHAR, WRITE_INT, FLUSH:
+		READ_CHAR, WRITE_CHAR, WRITE_INT, FLUSH, FLUSH_ALT,
+		STORE_VAR, FETCH_VAR:
 		return true
 	default:
 		return false
@@ -102,20 +120,18 @@ func (ti *TokenInput) ReadString() (string, error) {
 	b := make([]rune, 0)
 	if ti.IsString() {
 		ti.Input.Next()
-		escaped := false
+		// FALSE strings have no escapes, everything up to the next quote is written as is
+		closed := false
 		for !ti.Input.Eof() {
 			c := ti.Input.Next()
-			if escaped {
-				escaped = false
-			} else if c == '\\' {
-				escaped = true
-				continue
-			}
-			b = append(b, c)
-			if ti.IsString() {
-				ti.Input.Next()
+			if c == '"' {
+				closed = true
 				break
 			}
+			b = append(b, c)
+		}
+		if !closed {
+			return "", errors.New("string is not closed")
 		}
 	} else {
 		err := errors.New("not a string")
@@ -156,6 +172,21 @@ func (ti *TokenInput) ReadVar() (string, rune, error) {
 	return string(b), mode, nil
 }
 
+// ReadVarRef Read variable and store or fetch mode right after it, mode is 0 when the variable address is used as value
+func (ti *TokenInput) ReadVarRef() (string, rune, error) {
+	if !ti.IsVar() {
+		err := errors.New("not a variable")
+		ti.Input.Croak(err.Error())
+		return "", 0, err
+	}
+	v := string(ti.Input.Next())
+	switch ti.Input.Peek() {
+	case STORE_VAR, FETCH_VAR:
+		return v, ti.Input.Next(), nil
+	}
+	return v, 0, nil
+}
+
 func (ti *TokenInput) IsSubStart() bool {
 	b := ti.Input.Peek()
 	return b == '['
@@ -216,27 +247,24 @@ func (ti *TokenInput) IsCommentStart() bool {
 }
 
 func (ti *TokenInput) IsCommentEnd() bool {
-	return ti.Input.Peek() == '{'
+	return ti.Input.Peek() == '}'
 }
 
 func (ti *TokenInput) ReadComment() (string, error) {
 	b := make([]rune, 0)
 	if ti.IsCommentStart() {
 		ti.Input.Next()
-		escaped := false
+		closed := false
 		for !ti.Input.Eof() {
-			c := ti.Input.Next()
-			if escaped {
-				escaped = false
-			} else if c == '\\' {
-				escaped = true
-				continue
-			}
-			b = append(b, c)
 			if ti.IsCommentEnd() {
 				ti.Input.Next()
+				closed = true
 				break
 			}
+			b = append(b, ti.Input.Next())
+		}
+		if !closed {
+			return "", errors.New("comment is not closed")
 		}
 	} else {
 		err := errors.New("not a comment")
@@ -267,3 +295,109 @@ func (ti *TokenInput) NextSkipWhitespaces() rune {
 func (ti *TokenInput) Eof() bool {
 	return ti.Input.Eof()
 }
+
+type tokenKind int
+
+const (
+	// tokPush Integer or char constant
+	tokPush tokenKind = iota
+	// tokInline Integer written to the code as is
+	tokInline
+	tokVar
+	tokSubStart
+	tokSubEnd
+	tokCall
+	tokIf
+	tokWhile
+	// tokCommand Command of InstrMap
+	tokCommand
+	tokString
+	tokEOF
+)
+
+// token Operation of the program with its source position, shared by the compiler and the checker
+type token struct {
+	kind tokenKind
+	// value Constant, inline word or variable index
+	value int
+	// mode Variable store, fetch or address mode
+	mode rune
+	cmd  rune
+	text string
+	pos
+}
+
+// ReadToken Read the next operation skipping whitespaces and comments, erroneous tokens are reported to diags (or
+// croaked by the input) and ok is false
+func (ti *TokenInput) ReadToken(diags *input.Diagnostics) (t token, ok bool) {
+	for ti.IsWhitespace() || ti.IsCommentStart() {
+		if ti.IsWhitespace() {
+			ti.SkipWhitespace()
+			continue
+		}
+		line, col := ti.Input.Pos()
+		if _, err := ti.ReadComment(); err != nil {
+			diags.Errorf(line, col, "%s", err.Error())
+		}
+	}
+	line, col := ti.Input.Pos()
+	t.pos = pos{line, col}
+	switch {
+	case ti.Eof():
+		t.kind = tokEOF
+	case ti.IsInt():
+		v, err := ti.ReadInt()
+		if err != nil {
+			return t, false
+		}
+		t.kind, t.value = tokPush, v
+		if ti.IsInline() {
+			ti.SkipInline()
+			t.kind = tokInline
+		}
+	case ti.IsCharCode():
+		v, err := ti.ReadCharCode()
+		if err != nil {
+			return t, false
+		}
+		t.kind, t.value = tokPush, int(v)
+	case ti.IsVar():
+		v, m, err := ti.ReadVarRef()
+		if err != nil {
+			return t, false
+		}
+		t.kind, t.value, t.mode = tokVar, int(v[0]-'a'), m
+	case ti.IsSubStart():
+		ti.SkipSubStart()
+		t.kind = tokSubStart
+	case ti.IsSubEnd():
+		ti.SkipSubEnd()
+		t.kind = tokSubEnd
+	case ti.IsSubCall():
+		ti.SkipSubCall()
+		t.kind = tokCall
+	case ti.IsIf():
+		ti.SkipIf()
+		t.kind = tokIf
+	case ti.IsWhile():
+		ti.SkipWhile()
+		t.kind = tokWhile
+	case ti.IsCommand():
+		c, err := ti.ReadCommand()
+		if err != nil {
+			return t, false
+		}
+		t.kind, t.cmd = tokCommand, c
+	case ti.IsString():
+		s, err := ti.ReadString()
+		if err != nil {
+			diags.Errorf(line, col, "%s", err.Error())
+			return t, false
+		}
+		t.kind, t.text = tokString, s
+	default:
+		diags.Errorf(line, col, "unknown command: %q", ti.Input.Next())
+		return t, false
+	}
+	return t, true
+}
@@ -28,7 +28,7 @@ func TestTokenInput_IsInt(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			if got := ti.IsInt(); got != tt.want {
 				t.Errorf("IsInt() = %v, want %v", got, tt.want)
@@ -75,7 +75,7 @@ func TestTokenInput_ReadInt(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			got, err := ti.ReadInt()
 			if (err != nil) != tt.wantErr {
@@ -112,7 +112,7 @@ func TestTokenInput_IsCharCode(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			if got := ti.IsCharCode(); got != tt.want {
 				t.Errorf("IsCharCode() = %v, want %v", got, tt.want)
@@ -128,19 +128,19 @@ func TestTokenInput_ReadCharCode(t *testing.T) {
 	tests := []struct {
 		name    string
 		fields  fields
-		want    int
+		want    rune
 		wantErr bool
 	}{
 		{
 			name:    "check 'a is read as char a",
 			fields:  struct{ Input input.StringInput }{Input: input.StringInput{Str: "'a"}},
-			want:    int('a'),
+			want:    'a',
 			wantErr: false,
 		},
 		{
 			name:    "check 'aa is read as char a",
 			fields:  struct{ Input input.StringInput }{Input: input.StringInput{Str: "'aa"}},
-			want:    int('a'),
+			want:    'a',
 			wantErr: false,
 		},
 		{
@@ -153,7 +153,7 @@ func TestTokenInput_ReadCharCode(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			got, err := ti.ReadCharCode()
 			if (err != nil) != tt.wantErr {
@@ -255,7 +255,7 @@ func TestTokenInput_IsCommand(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			if got := ti.IsCommand(); got != tt.want {
 				t.Errorf("IsCommand() = %v, want %v", got, tt.want)
@@ -287,7 +287,7 @@ func TestTokenInput_IsString(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			if got := ti.IsString(); got != tt.want {
 				t.Errorf("IsString() = %v, want %v", got, tt.want)
@@ -334,7 +334,7 @@ func TestTokenInput_ReadString(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			got, err := ti.ReadString()
 			if (err != nil) != tt.wantErr {
@@ -376,7 +376,7 @@ func TestTokenInput_IsVar(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			if got := ti.IsVar(); got != tt.want {
 				t.Errorf("IsVar() = %v, want %v", got, tt.want)
@@ -435,7 +435,7 @@ func TestTokenInput_ReadVar(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			got, got1, err := ti.ReadVar()
 			if (err != nil) != tt.wantErr {
@@ -480,7 +480,7 @@ func TestTokenInput_IsSubStart(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			if got := ti.IsSubStart(); got != tt.want {
 				t.Errorf("IsSubStart() = %v, want %v", got, tt.want)
@@ -517,7 +517,7 @@ func TestTokenInput_IsSubEnd(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			if got := ti.IsSubEnd(); got != tt.want {
 				t.Errorf("IsSubEnd() = %v, want %v", got, tt.want)
@@ -554,7 +554,7 @@ func TestTokenInput_IsSubCall(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			if got := ti.IsSubCall(); got != tt.want {
 				t.Errorf("IsSubCall() = %v, want %v", got, tt.want)
@@ -591,7 +591,7 @@ func TestTokenInput_NextSkipWhitespaces(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ti := &TokenInput{
-				Input: tt.fields.Input,
+				Input: &tt.fields.Input,
 			}
 			if got := ti.NextSkipWhitespaces(); got != tt.want {
 				t.Errorf("NextSkipWhitespaces() = %v, want %v", got, tt.want)
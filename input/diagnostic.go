@@ -0,0 +1,216 @@
+package input
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Severity Importance of the diagnostic, only errors fail the compilation
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic Compiler message with its source position
+type Diagnostic struct {
+	Severity Severity
+	Message  string
+	File     string
+	Line     int
+	Col      int
+	// Excerpt Source line with caret under the column
+	Excerpt string
+}
+
+func (d Diagnostic) Error() string {
+	pos := fmt.Sprintf("%d:%d", d.Line, d.Col)
+	if d.File != "" {
+		pos = d.File + ":" + pos
+	}
+	return fmt.Sprintf("%s: %s: %s", pos, d.Severity, d.Message)
+}
+
+// Streamed source kept for excerpts: number of the recent lines and bytes of every line
+const (
+	excerptLines = 1000
+	excerptWidth = 512
+)
+
+// Diagnostics Messages collected during compilation of the source, so a single compile reports all errors
+type Diagnostics struct {
+	File string
+	List []Diagnostic
+	// lines Complete source lines starting from the line number first, only the recent ones are kept when the
+	// source is streamed, so diagnostics on older lines have no excerpt
+	lines []string
+	first int
+	// cur Incomplete last line, pending Diagnostics on it which excerpts are updated until it is complete
+	cur     []byte
+	pending []int
+}
+
+func NewDiagnostics(file string, src string) *Diagnostics {
+	lines := strings.Split(src, "\n")
+	last := len(lines) - 1
+	return &Diagnostics{File: file, lines: lines[:last], first: 1, cur: []byte(lines[last])}
+}
+
+// Write Append the source read so far, excerpts of diagnostics on the incomplete line are updated
+func (d *Diagnostics) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		seg, rest, found := bytes.Cut(p, []byte{'\n'})
+		// Long lines are cut, so a single line source can't take the memory either
+		if room := excerptWidth - len(d.cur); room > 0 {
+			d.cur = append(d.cur, seg[:min(room, len(seg))]...)
+		}
+		d.refresh()
+		if !found {
+			break
+		}
+		d.lines = append(d.lines, string(d.cur))
+		d.cur = d.cur[:0]
+		pending := d.pending[:0]
+		for _, i := range d.pending {
+			if d.List[i].Line >= d.first+len(d.lines) {
+				pending = append(pending, i)
+			}
+		}
+		d.pending = pending
+		if len(d.lines) >= 2*excerptLines {
+			drop := len(d.lines) - excerptLines
+			d.lines = append(make([]string, 0, 2*excerptLines), d.lines[drop:]...)
+			d.first += drop
+		}
+		p = rest
+	}
+	return n, nil
+}
+
+// refresh Update excerpts of the diagnostics on the incomplete line
+func (d *Diagnostics) refresh() {
+	for _, i := range d.pending {
+		d.List[i].Excerpt = d.excerpt(d.List[i].Line, d.List[i].Col)
+	}
+}
+
+// SourceName File name of the reader if it is a file
+func SourceName(r io.Reader) string {
+	if f, ok := r.(interface{ Name() string }); ok {
+		return f.Name()
+	}
+	return ""
+}
+
+func (d *Diagnostics) Errorf(line int, col int, format string, args ...any) {
+	d.Add(SeverityError, line, col, fmt.Sprintf(format, args...))
+}
+
+func (d *Diagnostics) Warnf(line int, col int, format string, args ...any) {
+	d.Add(SeverityWarning, line, col, fmt.Sprintf(format, args...))
+}
+
+func (d *Diagnostics) Add(s Severity, line int, col int, msg string) {
+	if line >= d.first+len(d.lines) {
+		d.pending = append(d.pending, len(d.List))
+	}
+	d.List = append(d.List, Diagnostic{
+		Severity: s,
+		Message:  msg,
+		File:     d.File,
+		Line:     line,
+		Col:      col,
+		Excerpt:  d.excerpt(line, col),
+	})
+}
+
+// excerpt Source line and caret line under the column, tabs are kept to align the caret, it is empty if the line
+// is not kept or the column is out of its kept part
+func (d *Diagnostics) excerpt(line int, col int) string {
+	var src string
+	switch i := line - d.first; {
+	case i >= 0 && i < len(d.lines):
+		src = d.lines[i]
+	case i == len(d.lines):
+		src = string(d.cur)
+	default:
+		return ""
+	}
+	src = strings.ToValidUTF8(strings.TrimRight(src, "\r"), "")
+	runes := []rune(src)
+	if col-1 > len(runes) {
+		return ""
+	}
+	pad := make([]rune, 0, col)
+	for i, c := range runes {
+		if i >= col-1 {
+			break
+		}
+		if c != '\t' {
+			c = ' '
+		}
+		pad = append(pad, c)
+	}
+	return src + "\n" + string(pad) + "^"
+}
+
+func (d *Diagnostics) HasErrors() bool {
+	for _, m := range d.List {
+		if m.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Err Compilation error with all diagnostics sorted by position or nil if there are no errors
+func (d *Diagnostics) Err() error {
+	if !d.HasErrors() {
+		return nil
+	}
+	list := append([]Diagnostic(nil), d.List...)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Line < list[j].Line || (list[i].Line == list[j].Line && list[i].Col < list[j].Col)
+	})
+	return &Error{Diagnostics: list}
+}
+
+// Error Failed compilation with its diagnostics
+type Error struct {
+	Diagnostics []Diagnostic
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		msgs[i] = d.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Render Write every diagnostic with its source excerpt
+func Render(w io.Writer, list []Diagnostic) error {
+	for _, d := range list {
+		if _, err := fmt.Fprintln(w, d.Error()); err != nil {
+			return err
+		}
+		if d.Excerpt != "" {
+			if _, err := fmt.Fprintln(w, d.Excerpt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
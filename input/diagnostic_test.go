@@ -0,0 +1,77 @@
+package input
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDiagnostics_Err(t *testing.T) {
+	d := NewDiagnostics("prog.f", "1 2+\n\t[ x\n")
+	if err := d.Err(); err != nil {
+		t.Fatalf("Err() = %v, want nil", err)
+	}
+	d.Warnf(1, 3, "unused value")
+	if err := d.Err(); err != nil {
+		t.Fatalf("Err() with warning = %v, want nil", err)
+	}
+	d.Errorf(2, 4, "unknown command: %q", 'x')
+	d.Errorf(2, 2, "unbalanced [")
+
+	var ce *Error
+	if !errors.As(d.Err(), &ce) {
+		t.Fatalf("Err() = %v, want *Error", d.Err())
+	}
+	want := "prog.f:1:3: warning: unused value\n" +
+		"prog.f:2:2: error: unbalanced [\n" +
+		"prog.f:2:4: error: unknown command: 'x'"
+	if got := ce.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	w := new(bytes.Buffer)
+	if err := Render(w, ce.Diagnostics[2:]); err != nil {
+		t.Fatal(err)
+	}
+	want = "prog.f:2:4: error: unknown command: 'x'\n\t[ x\n\t  ^\n"
+	if got := w.String(); got != want {
+		t.Errorf("Render() = %q, want %q", got, want)
+	}
+}
+
+func TestDiagnostics_Window(t *testing.T) {
+	d := NewDiagnostics("", "")
+	long := strings.Repeat("x", 2*excerptWidth)
+	for i := 0; i < 3*excerptLines; i++ {
+		if _, err := d.Write([]byte("line\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Write([]byte(long + "\nlast")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.lines); n >= 2*excerptLines {
+		t.Errorf("kept %d lines, want less than %d", n, 2*excerptLines)
+	}
+	last := 3*excerptLines + 2
+	tests := []struct {
+		name string
+		line int
+		col  int
+		want string
+	}{
+		{name: "check dropped line", line: 1, col: 1, want: ""},
+		{name: "check recent line", line: last - 2, col: 2, want: "line\n ^"},
+		{name: "check cut long line", line: last - 1, col: 3, want: long[:excerptWidth] + "\n  ^"},
+		{name: "check column out of cut line", line: last - 1, col: excerptWidth + 10, want: ""},
+		{name: "check incomplete line", line: last, col: 5, want: "last\n    ^"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.excerpt(tt.line, tt.col); got != tt.want {
+				t.Errorf("excerpt(%d, %d) = %q, want %q", tt.line, tt.col, got, tt.want)
+			}
+		})
+	}
+}
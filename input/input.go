@@ -4,5 +4,7 @@ type RuneInput interface {
 	Peek() rune
 	Next() rune
 	Eof() bool
+	// Pos Line and column (both 1-based) of the next rune
+	Pos() (int, int)
 	Croak(msg string)
 }
@@ -0,0 +1,111 @@
+package input
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Language Frontend compiling sources to the VM bytecode, frontends register themselves on init
+type Language struct {
+	Name string
+	// Aliases Other names accepted by LookupLanguage
+	Aliases []string
+	// Extensions Source file extensions with the dot, in lower case
+	Extensions []string
+	// New Parser with the default options
+	New func() Parser
+}
+
+var languages = map[string]Language{}
+
+// Register Add the language or replace the registered one of the same name
+func Register(l Language) {
+	languages[l.Name] = l
+}
+
+// Languages Registered languages sorted by name
+func Languages() []Language {
+	list := make([]Language, 0, len(languages))
+	for _, l := range languages {
+		list = append(list, l)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// LookupLanguage Registered language by its name or alias
+func LookupLanguage(name string) (Language, error) {
+	name = strings.ToLower(name)
+	for _, l := range Languages() {
+		if l.Name == name {
+			return l, nil
+		}
+		for _, a := range l.Aliases {
+			if a == name {
+				return l, nil
+			}
+		}
+	}
+	return Language{}, fmt.Errorf("unsupported language: %s", name)
+}
+
+// DetectLanguage Language named in the shebang-like first line (e.g. "#!/usr/bin/env false-vm -l bf")
+// or registered for the file extension
+func DetectLanguage(file string, shebang string) (Language, error) {
+	if strings.HasPrefix(shebang, "#!") {
+		for _, f := range strings.Fields(shebang[2:]) {
+			if l, err := LookupLanguage(filepath.Base(f)); err == nil {
+				return l, nil
+			}
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, l := range Languages() {
+		for _, e := range l.Extensions {
+			if e == ext {
+				return l, nil
+			}
+		}
+	}
+	if ext == "" {
+		return Language{}, fmt.Errorf("unable to detect language of %s: no file extension or #! line", file)
+	}
+	return Language{}, fmt.Errorf("unsupported file extension: %s", ext)
+}
+
+// namedReader Reader keeping the file name of the wrapped one for SourceName
+type namedReader struct {
+	io.Reader
+	name string
+}
+
+func (r namedReader) Name() string {
+	return r.name
+}
+
+// ReadShebang Read the shebang-like first line starting with "#!", the returned reader reads the source with that line
+// blanked, so it isn't compiled and positions of the rest are kept
+func ReadShebang(r io.Reader) (string, io.Reader, error) {
+	name := SourceName(r)
+	br := bufio.NewReader(r)
+	wrap := func(r io.Reader) io.Reader {
+		if name == "" {
+			return r
+		}
+		return namedReader{Reader: r, name: name}
+	}
+	if b, _ := br.Peek(2); string(b) != "#!" {
+		return "", wrap(br), nil
+	}
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	return strings.TrimRight(line, "\r\n"), wrap(io.MultiReader(strings.NewReader("\n"), br)), nil
+}
@@ -0,0 +1,70 @@
+package input
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	saved := languages
+	defer func() {
+		languages = saved
+	}()
+	languages = map[string]Language{}
+	Register(Language{Name: "bf", Aliases: []string{"brainfuck"}, Extensions: []string{".bf", ".b"}})
+	Register(Language{Name: "false", Extensions: []string{".false", ".f"}})
+
+	tests := []struct {
+		name    string
+		file    string
+		shebang string
+		want    string
+		wantErr bool
+	}{
+		{name: "check extension", file: "samples/hello.bf", want: "bf"},
+		{name: "check extension case", file: "PROG.F", want: "false"},
+		{name: "check shebang", file: "prog", shebang: "#!/usr/local/bin/false", want: "false"},
+		{name: "check shebang alias", file: "prog", shebang: "#!/usr/bin/env false-vm -l brainfuck", want: "bf"},
+		{name: "check shebang over extension", file: "prog.f", shebang: "#!/usr/bin/env false-vm -l bf", want: "bf"},
+		{name: "check unknown shebang", file: "prog.b", shebang: "#!/bin/sh", want: "bf"},
+		{name: "check unknown extension", file: "notes.md", wantErr: true},
+		{name: "check no extension", file: "prog", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := DetectLanguage(tt.file, tt.shebang)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DetectLanguage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if l.Name != tt.want {
+				t.Errorf("DetectLanguage() = %q, want %q", l.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadShebang(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		shebang string
+		want    string
+	}{
+		{name: "check shebang line is blanked", src: "#!false-vm -l bf\r\n+.\n", shebang: "#!false-vm -l bf", want: "\n+.\n"},
+		{name: "check shebang only", src: "#!bf", shebang: "#!bf", want: "\n"},
+		{name: "check source without shebang", src: "# comment\n1", want: "# comment\n1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shebang, r, err := ReadShebang(strings.NewReader(tt.src))
+			if err != nil {
+				t.Fatalf("ReadShebang() error = %v", err)
+			}
+			got, _ := io.ReadAll(r)
+			if shebang != tt.shebang || string(got) != tt.want {
+				t.Errorf("ReadShebang() = %q, %q, want %q, %q", shebang, got, tt.shebang, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package input
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"unicode/utf8"
+)
+
+// ReaderInput Streaming input decoding runes from the reader on demand, so the source is never read in memory at once
+type ReaderInput struct {
+	// File Source name for messages
+	File string
+	// Diags Diagnostics Croak adds errors to, they are logged if it is nil
+	Diags *Diagnostics
+	r     *bufio.Reader
+	// ahead Runes read but not taken yet
+	ahead []rune
+	err   error
+	line  int
+	col   int
+	// cr Previous rune is CR, so LF after it doesn't break the line again
+	cr  bool
+	buf [utf8.UTFMax]byte
+}
+
+// NewReaderInput Input reading the reader, taken runes are written to diags (if it is not nil) for excerpts, so
+// they are kept only for the recent lines
+func NewReaderInput(r io.Reader, diags *Diagnostics) *ReaderInput {
+	return &ReaderInput{File: SourceName(r), Diags: diags, r: bufio.NewReader(r)}
+}
+
+func (s *ReaderInput) Peek() rune {
+	return s.PeekAt(0)
+}
+
+// PeekAt Rune n positions ahead of the next one without taking it, 0 after the end of input
+func (s *ReaderInput) PeekAt(n int) rune {
+	if !s.fill(n + 1) {
+		return 0
+	}
+	return s.ahead[n]
+}
+
+func (s *ReaderInput) Next() rune {
+	if !s.fill(1) {
+		return 0
+	}
+	c := s.ahead[0]
+	s.ahead = s.ahead[1:]
+	// Diagnostics get LF for every line break the same as counted here
+	n := 0
+	switch {
+	case c == '\n' && s.cr:
+		s.cr = false
+	case c == '\n' || c == '\r':
+		s.line++
+		s.col = 0
+		s.cr = c == '\r'
+		s.buf[0], n = '\n', 1
+	default:
+		s.col++
+		s.cr = false
+		n = utf8.EncodeRune(s.buf[:], c)
+	}
+	if s.Diags != nil && n > 0 {
+		_, _ = s.Diags.Write(s.buf[:n])
+	}
+	return c
+}
+
+func (s *ReaderInput) Eof() bool {
+	return !s.fill(1)
+}
+
+func (s *ReaderInput) Pos() (int, int) {
+	return s.line + 1, s.col + 1
+}
+
+func (s *ReaderInput) Croak(msg string) {
+	line, col := s.Pos()
+	if s.Diags != nil {
+		s.Diags.Errorf(line, col, "%s", msg)
+		return
+	}
+	if s.File != "" {
+		log.Printf("%s (%s:%d:%d)\n", msg, s.File, line, col)
+		return
+	}
+	log.Printf("%s (%d:%d)\n", msg, line, col)
+}
+
+// Err Read error other than the end of input
+func (s *ReaderInput) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// fill Read runes ahead until there are n of them, false is returned if the input ends before
+func (s *ReaderInput) fill(n int) bool {
+	for len(s.ahead) < n && s.err == nil {
+		c, w, err := s.r.ReadRune()
+		if err != nil {
+			s.err = err
+			break
+		}
+		if c == utf8.RuneError && w == 1 {
+			// Not UTF-8, so the byte is taken as ISO-8859-1 char (classic FALSE sources use it for ø and ß)
+			_ = s.r.UnreadRune()
+			b, _ := s.r.ReadByte()
+			c = rune(b)
+		}
+		s.ahead = append(s.ahead, c)
+	}
+	return len(s.ahead) >= n
+}
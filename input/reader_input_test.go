@@ -0,0 +1,117 @@
+package input
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// position Rune with the position it is read from
+type position struct {
+	c    rune
+	line int
+	col  int
+}
+
+func readAll(in RuneInput) []position {
+	var got []position
+	for !in.Eof() {
+		line, col := in.Pos()
+		got = append(got, position{in.Next(), line, col})
+	}
+	return got
+}
+
+func TestReaderInput_Pos(t *testing.T) {
+	src := "a\r\nb\rc\n\nd"
+	want := []position{
+		{'a', 1, 1}, {'\r', 1, 2}, {'\n', 2, 1},
+		{'b', 2, 1}, {'\r', 2, 2},
+		{'c', 3, 1}, {'\n', 3, 2},
+		{'\n', 4, 1},
+		{'d', 5, 1},
+	}
+	inputs := map[string]RuneInput{
+		"reader": NewReaderInput(iotest.OneByteReader(strings.NewReader(src)), nil),
+		"string": &StringInput{Str: src},
+	}
+	for name, in := range inputs {
+		t.Run(name, func(t *testing.T) {
+			got := readAll(in)
+			if len(got) != len(want) {
+				t.Fatalf("read %d runes, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("rune %d = %q at %d:%d, want %q at %d:%d",
+						i, got[i].c, got[i].line, got[i].col, want[i].c, want[i].line, want[i].col)
+				}
+			}
+		})
+	}
+}
+
+func TestReaderInput_PeekAt(t *testing.T) {
+	// ø is UTF-8 and \xdf is ISO-8859-1 ß
+	in := NewReaderInput(iotest.HalfReader(strings.NewReader("1ø\xdf2")), nil)
+	if got := in.PeekAt(2); got != 'ß' {
+		t.Errorf("PeekAt(2) = %q, want 'ß'", got)
+	}
+	if got := in.PeekAt(4); got != 0 {
+		t.Errorf("PeekAt(4) = %q, want 0", got)
+	}
+	var got []rune
+	for !in.Eof() {
+		got = append(got, in.Next())
+	}
+	if string(got) != "1øß2" {
+		t.Errorf("Next() runes = %q, want %q", string(got), "1øß2")
+	}
+	if line, col := in.Pos(); line != 1 || col != 5 {
+		t.Errorf("Pos() = %d:%d, want 1:5", line, col)
+	}
+	if err := in.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+}
+
+func TestReaderInput_Croak(t *testing.T) {
+	d := NewDiagnostics("prog.f", "")
+	in := NewReaderInput(iotest.OneByteReader(strings.NewReader("12\n3 x 4\n")), d)
+	for !in.Eof() && in.Peek() != 'x' {
+		in.Next()
+	}
+	// Line is read only up to the error when it is croaked, excerpt is completed by the following reads
+	in.Croak("unknown command")
+	for !in.Eof() {
+		in.Next()
+	}
+	want := Diagnostic{
+		Severity: SeverityError,
+		Message:  "unknown command",
+		File:     "prog.f",
+		Line:     2,
+		Col:      3,
+		Excerpt:  "3 x 4\n  ^",
+	}
+	if len(d.List) != 1 || d.List[0] != want {
+		t.Errorf("Croak() diagnostics = %+v, want %+v", d.List, want)
+	}
+}
+
+func TestReaderInput_Err(t *testing.T) {
+	fail := errors.New("read failed")
+	in := NewReaderInput(iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("ab"))), nil)
+	got := readAll(in)
+	if len(got) != 1 {
+		t.Errorf("read %d runes, want 1", len(got))
+	}
+	if err := in.Err(); !errors.Is(err, iotest.ErrTimeout) {
+		t.Errorf("Err() = %v, want %v", err, iotest.ErrTimeout)
+	}
+	in = NewReaderInput(iotest.ErrReader(fail), nil)
+	if !in.Eof() || !errors.Is(in.Err(), fail) {
+		t.Errorf("Eof() = %v, Err() = %v, want true and %v", in.Eof(), in.Err(), fail)
+	}
+}
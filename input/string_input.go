@@ -6,10 +6,14 @@ import (
 )
 
 type StringInput struct {
-	Str  string
-	pos  int
-	line int
-	col  int
+	Str string
+	// Diags Diagnostics Croak adds errors to, they are logged if it is nil
+	Diags *Diagnostics
+	pos   int
+	line  int
+	col   int
+	// cr Previous rune is CR, so LF after it doesn't break the line again
+	cr bool
 }
 
 func (s *StringInput) Peek() rune {
@@ -20,11 +24,16 @@ func (s *StringInput) Peek() rune {
 func (s *StringInput) Next() rune {
 	c, w := s.getChar(s.pos)
 	s.pos += w
-	if c == '\n' || c == '\r' {
+	switch {
+	case c == '\n' && s.cr:
+		s.cr = false
+	case c == '\n' || c == '\r':
 		s.line++
 		s.col = 0
-	} else {
+		s.cr = c == '\r'
+	default:
 		s.col++
+		s.cr = false
 	}
 	return c
 }
@@ -33,13 +42,26 @@ func (s *StringInput) Eof() bool {
 	return s.Peek() == 0
 }
 
+func (s *StringInput) Pos() (int, int) {
+	return s.line + 1, s.col + 1
+}
+
 func (s *StringInput) Croak(msg string) {
-	log.Printf("%s (%d:%d)\n", msg, s.line, s.col)
+	line, col := s.Pos()
+	if s.Diags != nil {
+		s.Diags.Errorf(line, col, "%s", msg)
+		return
+	}
+	log.Printf("%s (%d:%d)\n", msg, line, col)
 }
 
 func (s *StringInput) getChar(pos int) (rune, int) {
 	if pos >= 0 && pos < len(s.Str) {
 		c, w := utf8.DecodeRuneInString(s.Str[pos:])
+		if c == utf8.RuneError && w == 1 {
+			// Not UTF-8, so the byte is taken as ISO-8859-1 char (classic FALSE sources use it for ø and ß)
+			c = rune(s.Str[pos])
+		}
 		return c, w
 	}
 	return 0, 0
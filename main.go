@@ -1,105 +1,320 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"false-vm/arithmetic"
+	"context"
+	"errors"
 	"false-vm/bf"
-	false2 "false-vm/false"
+	"false-vm/engine"
 	"false-vm/input"
 	vm2 "false-vm/vm"
 	"flag"
 	"fmt"
+	"golang.org/x/term"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 	"time"
 )
 
-func main() {
-	var bcf string
-	var src string
-	var lang string
-	var out string
-	var run bool
-	var verbose bool
-	var memSize int
-	var opStackSize int
-	var callStackSize int
-	flag.StringVar(&bcf, "b", "", "bytecode file (has more priority than source file parameter)")
-	flag.StringVar(&src, "s", "", "source file (.bf and .false are supported)")
-	flag.StringVar(&lang, "l", "auto", "force set language: auto (autodetect by file extension), false - FALSE, bf - Brainfuck")
-	flag.StringVar(&out, "o", "", "output compiled bytecode to file")
-	flag.BoolVar(&run, "r", true, "run compiled file")
-	flag.BoolVar(&verbose, "v", false, "verbose log mode")
-	flag.IntVar(&memSize, "m", 131072, "total memory size (32-bit integers)")
-	flag.IntVar(&opStackSize, "os", 1280, "operation stack size (part of total memory; 32-bit integers)")
-	flag.IntVar(&callStackSize, "cs", 640, "call stack size (part of total memory; 32-bit integers)")
-	flag.Parse()
+// commands Subcommands, running the program is the default one
+var commands = map[string]func(args []string){
+	"debug":     debugCommand,
+	"dis":       disCommand,
+	"check":     checkCommand,
+	"languages": languagesCommand,
+	"repl":      replCommand,
+}
 
-	var err error
-	var bc []byte
-	if bcf != "" {
-		if bc, err = os.ReadFile(bcf); err != nil {
-			log.Fatalln("unable to read bytecode file:", err.Error())
-		}
-	} else {
-		if src == "" {
-			log.Fatalln("source file is required")
-		}
-
-		if lang == "auto" {
-			ext := strings.ToLower(filepath.Ext(src))
-			switch ext {
-			case ".bf":
-				lang = "bf"
-				break
-			case ".f":
-			case ".false":
-				lang = "false"
-				break
-			case ".txt":
-				lang = "arithmetic"
-				break
-			default:
-				log.Fatalln("unsupported file extension:", ext)
-			}
+// programFlags Flags shared by commands to get the program bytecode and set up the VM
+type programFlags struct {
+	fs            *flag.FlagSet
+	bcf           string
+	src           string
+	lang          string
+	memSize       int
+	opStackSize   int
+	callStackSize int
+	arith         string
+	divZero       string
+	opt           int
+	bfTape        int
+	bfCell        int
+	bfPointer     string
+	bfEOF         string
+	bfEcho        bool
+	bfCRToLF      bool
+}
+
+func (f *programFlags) register(fs *flag.FlagSet) {
+	f.fs = fs
+	fs.StringVar(&f.bcf, "b", "", "bytecode file (has more priority than source file parameter)")
+	var names, exts []string
+	for _, l := range input.Languages() {
+		names = append(names, l.Name)
+		exts = append(exts, l.Extensions...)
+	}
+	fs.StringVar(&f.src, "s", "", "source file ("+strings.Join(exts, ", ")+" are supported)")
+	fs.StringVar(&f.lang, "l", "auto", "force set language: auto (autodetect by file extension or #! line), "+strings.Join(names, ", ")+" (see languages command)")
+	fs.IntVar(&f.memSize, "m", engine.DefaultMemSize, "total memory size (32-bit integers)")
+	fs.IntVar(&f.opStackSize, "os", engine.DefaultOpStackSize, "operation stack size (part of total memory; 32-bit integers)")
+	fs.IntVar(&f.callStackSize, "cs", engine.DefaultCallStackSize, "call stack size (part of total memory; 32-bit integers)")
+	fs.StringVar(&f.arith, "arith", "wrap", "32-bit overflow handling: wrap, saturate or trap")
+	fs.StringVar(&f.divZero, "divzero", "fault", "division by zero handling: fault or zero")
+	fs.IntVar(&f.bfTape, "bf-tape", bf.DefaultTapeSize, "Brainfuck tape size (cells)")
+	fs.IntVar(&f.bfCell, "bf-cell", bf.DefaultCellBits, "Brainfuck cell width: 8, 16 or 32 bits (8 and 16-bit cells wrap around)")
+	fs.StringVar(&f.bfPointer, "bf-pointer", "check", "Brainfuck tape pointer out of the tape: check (fault) or wrap")
+	fs.StringVar(&f.bfEOF, "bf-eof", "0", "Brainfuck cell value on end of input: 0, -1 or unchanged")
+	fs.BoolVar(&f.bfEcho, "bf-echo", false, "Brainfuck input is echoed to output (for terminal in raw mode)")
+	fs.BoolVar(&f.bfCRToLF, "bf-crlf", false, "Brainfuck input CR is read as LF (Enter key gives CR in terminal raw mode)")
+	fs.IntVar(&f.opt, "O", vm2.OptNone, "optimization level: 0 - none, 1 - peephole, 2 - peephole, jump threading and unreachable code removal")
+}
+
+// traceFlags Flags of the instruction trace written while running
+type traceFlags struct {
+	file   string
+	format string
+	depth  int
+	addr   string
+	ops    string
+}
+
+func (f *traceFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.file, "trace", "", "write instruction trace to file")
+	fs.StringVar(&f.format, "trace-format", "text", "trace format: text or json (JSON lines)")
+	fs.IntVar(&f.depth, "trace-depth", vm2.DefaultTraceDepth, "number of op stack top items traced before and after instruction")
+	fs.StringVar(&f.addr, "trace-addr", "", "traced address range from-to (to is exclusive), e.g. 10-40")
+	fs.StringVar(&f.ops, "trace-ops", "", "traced instructions, comma separated, e.g. Call,Return")
+}
+
+// tracer Create tracer writing to the file, nil if tracing is off
+func (f *traceFlags) tracer() (*vm2.Tracer, *os.File, error) {
+	if f.file == "" {
+		return nil, nil, nil
+	}
+	if f.depth < 0 {
+		return nil, nil, fmt.Errorf("invalid trace depth %d", f.depth)
+	}
+	format, err := vm2.ParseTraceFormat(f.format)
+	if err != nil {
+		return nil, nil, err
+	}
+	ops, err := vm2.ParseTraceOps(f.ops)
+	if err != nil {
+		return nil, nil, err
+	}
+	var from, to int
+	if f.addr != "" {
+		if from, to, err = vm2.ParseTraceRange(f.addr); err != nil {
+			return nil, nil, err
 		}
+	}
+	file, err := os.Create(f.file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create trace file: %w", err)
+	}
+	t := vm2.NewTracer(file, format)
+	t.Depth = f.depth
+	t.From, t.To = from, to
+	t.Ops = ops
+	return t, file, nil
+}
 
-		var p input.Parser
-		switch lang {
-		case "bf":
-			p = bf.NewParser()
-			break
-		case "false":
-			p = false2.NewParser()
-			break
-		case "arithmetic":
-			p = arithmetic.NewParser()
-			break
-		default:
-			log.Fatalln("unsupported language:", lang)
+// profileFlags Flags of the instruction profile collected while running
+type profileFlags struct {
+	file string
+	top  int
+}
+
+func (f *profileFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.file, "profile", "", "write instruction profile in pprof format to file (see go tool pprof)")
+	fs.IntVar(&f.top, "profile-top", 0, "print hot spots report with n top addresses, opcodes and lambdas after run (0 - off)")
+}
+
+// profiler Create profiler, nil if profiling is off
+func (f *profileFlags) profiler() *vm2.Profiler {
+	if f.file == "" && f.top <= 0 {
+		return nil
+	}
+	return vm2.NewProfiler()
+}
+
+// write Write the report and the pprof file of the profiler
+func (f *profileFlags) write(p *vm2.Profiler, img *vm2.Image) error {
+	if p == nil {
+		return nil
+	}
+	if f.top > 0 {
+		fmt.Println()
+		if err := p.WriteReport(os.Stdout, img, f.top); err != nil {
+			return err
 		}
+	}
+	if f.file == "" {
+		return nil
+	}
+	file, err := os.Create(f.file)
+	if err != nil {
+		return fmt.Errorf("unable to create profile file: %w", err)
+	}
+	if err = p.WritePprof(file, img); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
 
-		r, err := os.Open(src)
+// image Load or compile the program and optimize it
+func (f *programFlags) image() (*engine.Program, error) {
+	prog, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	if err = prog.Optimize(f.opt); err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+// load Load bytecode file (container or headerless) or compile source file
+func (f *programFlags) load() (*engine.Program, error) {
+	if f.bcf != "" {
+		bc, err := os.ReadFile(f.bcf)
 		if err != nil {
-			log.Fatalln("unable to open file:", err.Error())
+			return nil, fmt.Errorf("unable to read bytecode file: %w", err)
 		}
-		w := new(bytes.Buffer)
-		err = p.Parse(r, w)
+		prog, err := engine.Load(bc)
 		if err != nil {
-			log.Fatalln("parsing failed")
+			return nil, fmt.Errorf("invalid bytecode file: %w", err)
 		}
-		err = r.Close()
-		if err != nil {
-			log.Fatalln("closing failed")
+		return prog, nil
+	}
+	if f.src == "" {
+		return nil, errors.New("source file is required")
+	}
+
+	return engine.CompileFile(f.src, engine.CompileOptions{Lang: f.lang, Parser: f.parser})
+}
+
+// parser Create parser of the language, Brainfuck dialect is set by flags
+func (f *programFlags) parser(l input.Language) (input.Parser, error) {
+	if l.Name == "bf" {
+		return f.bfParser()
+	}
+	return l.New(), nil
+}
+
+// bfParser Create Brainfuck parser of the dialect set by flags
+func (f *programFlags) bfParser() (*bf.Parser, error) {
+	var err error
+	p := bf.NewParser()
+	p.TapeSize = f.bfTape
+	p.CellBits = f.bfCell
+	p.Echo = f.bfEcho
+	p.CRToLF = f.bfCRToLF
+	if p.Pointer, err = bf.ParsePointerMode(f.bfPointer); err != nil {
+		return nil, err
+	}
+	if p.EOF, err = bf.ParseEOFMode(f.bfEOF); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// fatal Log the error and exit, compilation diagnostics are written with source excerpts
+func fatal(err error) {
+	var ce *input.Error
+	if errors.As(err, &ce) {
+		_ = input.Render(os.Stderr, ce.Diagnostics)
+		log.Fatalf("parsing failed with %d error(s)\n", len(ce.Diagnostics))
+	}
+	log.Fatalln(err.Error())
+}
+
+// isSet Check the flag is passed explicitly
+func (f *programFlags) isSet(name string) bool {
+	set := false
+	f.fs.Visit(func(fl *flag.Flag) {
+		if fl.Name == name {
+			set = true
 		}
+	})
+	return set
+}
+
+// requestSizes Store explicitly passed memory sizes to the image header
+func (f *programFlags) requestSizes(img *vm2.Image) {
+	if f.isSet("m") {
+		img.MemSize = f.memSize
+	}
+	if f.isSet("os") {
+		img.OpStackSize = f.opStackSize
+	}
+	if f.isSet("cs") {
+		img.CallStackSize = f.callStackSize
+	}
+}
+
+// runOptions VM setup by flags, only explicitly passed sizes have priority over the sizes requested by image
+func (f *programFlags) runOptions() (engine.RunOptions, error) {
+	var err error
+	opts := engine.RunOptions{}
+	if f.isSet("m") {
+		opts.MemSize = f.memSize
+	}
+	if f.isSet("os") {
+		opts.OpStackSize = f.opStackSize
+	}
+	if f.isSet("cs") {
+		opts.CallStackSize = f.callStackSize
+	}
+	if opts.Arith, err = vm2.ParseArithMode(f.arith); err != nil {
+		return opts, err
+	}
+	if opts.DivZero, err = vm2.ParseDivZeroMode(f.divZero); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
+	var pf programFlags
+	var out string
+	var run bool
+	var verbose bool
+	var raw bool
+	var fuel int64
+	var timeout time.Duration
+	var tf traceFlags
+	var prf profileFlags
+	pf.register(flag.CommandLine)
+	tf.register(flag.CommandLine)
+	prf.register(flag.CommandLine)
+	flag.StringVar(&out, "o", "", "output compiled bytecode to file")
+	flag.BoolVar(&run, "r", true, "run compiled file")
+	flag.BoolVar(&verbose, "v", false, "verbose log mode")
+	flag.BoolVar(&raw, "raw", term.IsTerminal(int(os.Stdin.Fd())), "switch terminal to raw mode while running")
+	flag.Int64Var(&fuel, "fuel", 0, "maximum number of instructions to execute (0 - unlimited)")
+	flag.DurationVar(&timeout, "timeout", 0, "maximum execution time, e.g. 10s (0 - unlimited)")
+	flag.Parse()
 
-		bc = w.Bytes()
+	prog, err := pf.image()
+	if err != nil {
+		fatal(err)
 	}
+	img := prog.Image
 
 	if out != "" {
+		pf.requestSizes(img)
+		bc := prog.Encode()
 		if err := os.WriteFile(out, bc, 0644); err != nil {
 			log.Fatalln("bytecode writing failed with error,", err.Error())
 		}
@@ -107,32 +322,66 @@ func main() {
 	}
 
 	if run {
-		unitSize := 4
-		if len(bc)%unitSize != 0 {
-			log.Fatalln("invalid byte alignment")
-		}
-		v := ""
-		img := make([]int, len(bc)/unitSize)
-		c := 0
-		for i := 0; i < len(bc); i += unitSize {
-			u := binary.LittleEndian.Uint32(bc[i : i+unitSize])
-			img[c] = int(u)
-			c++
-			v += fmt.Sprintf("%d ", u)
-		}
-		logV(verbose, "image loaded: %s\n", v)
-
-		vm := vm2.NewVM(memSize, opStackSize, callStackSize)
-		err = vm.Load(img)
+		if verbose {
+			v := ""
+			for _, u := range img.Code {
+				v += fmt.Sprintf("%d ", u)
+			}
+			logV(verbose, "image loaded (version %d, language %q, entry %d): %s\n", img.Version, img.Lang, img.Entry, v)
+		}
+
+		opts, err := pf.runOptions()
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		opts.MaxInstructions = fuel
+		opts.Timeout = timeout
+		var tio *vm2.TermIO
+		if raw {
+			tio = vm2.NewTermIO(os.Stdin, os.Stdout)
+			opts.IO = tio
+		} else {
+			opts.Stdin, opts.Stdout = os.Stdin, os.Stdout
+		}
+		vm, err := prog.NewVM(opts)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		tracer, traceFile, err := tf.tracer()
 		if err != nil {
-			log.Fatalln("image loading failed:", err)
+			log.Fatalln(err.Error())
+		}
+		vm.Trace = tracer
+		vm.Profile = prf.profiler()
+
+		fmt.Print("vm started\n\n")
+		if tio != nil {
+			if err = tio.Open(); err != nil {
+				log.Fatalln("unable to switch terminal to raw mode:", err.Error())
+			}
 		}
 
 		before := time.Now().UnixMilli()
-		err := vm.Run()
+		err = vm.RunContext(context.Background(), opts.Limits())
 		after := time.Now().UnixMilli()
 
+		if tio != nil {
+			_ = tio.Close()
+		}
+		if tracer != nil {
+			if terr := tracer.Flush(); terr != nil {
+				log.Println("trace writing failed:", terr.Error())
+			}
+			_ = traceFile.Close()
+		}
+		if err == nil {
+			fmt.Print("\n\nvm gracefully stopped\n")
+		}
+
 		fmt.Printf("cpu time %d milliseconds\n", after-before)
+		if perr := prf.write(vm.Profile, img); perr != nil {
+			log.Println("profile writing failed:", perr.Error())
+		}
 
 		if err != nil {
 			log.Fatalln("vm fault:", err.Error())
@@ -143,6 +392,18 @@ func main() {
 	}
 }
 
+// languagesCommand Print registered languages with their aliases and file extensions
+func languagesCommand(args []string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tALIASES\tEXTENSIONS")
+	for _, l := range input.Languages() {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", l.Name, strings.Join(l.Aliases, ", "), strings.Join(l.Extensions, ", "))
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalln(err.Error())
+	}
+}
+
 func logV(verbose bool, format string, a ...any) {
 	if verbose {
 		fmt.Printf(format, a...)
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"false-vm/engine"
+	false2 "false-vm/false"
+	"false-vm/input"
+	vm2 "false-vm/vm"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+const replHelp = `commands:
+  :stack        print op stack, topmost first
+  :reset        clear variables, op stack and entered code
+  :dis          print listing of the entered code
+  :load <file>  compile and run FALSE source file
+  :help         print this help
+  :quit         exit REPL
+other lines are FALSE code, it is run at once and the op stack is printed after it (bottom first)
+`
+
+// repl FALSE session: every input is compiled to the code placed after the code entered before and run on the same VM,
+// so variables, lambdas and op stack are kept between inputs
+type repl struct {
+	opts engine.RunOptions
+	vm   *vm2.VM
+	in   *bufio.Reader
+	out  *lineWriter
+	// next Address of the next input code, the code starts from zero
+	next int
+	// vars Address of variables a-z, they are placed at the end of the program memory
+	vars int
+	// instrs, relocs, symbols Instruction starts, address words and variable names of the entered code for listing
+	instrs  []int
+	relocs  []int
+	symbols map[int]string
+}
+
+// lineWriter Writer remembering whether the output ends with line break
+type lineWriter struct {
+	w       io.Writer
+	newline bool
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		l.newline = p[len(p)-1] == '\n'
+	}
+	return l.w.Write(p)
+}
+
+func replCommand(args []string) {
+	var pf programFlags
+	var fuel int64
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	pf.register(fs)
+	fs.Int64Var(&fuel, "fuel", 0, "maximum number of instructions to execute by every input (0 - unlimited)")
+	_ = fs.Parse(args)
+
+	opts, err := pf.runOptions()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	opts.MaxInstructions = fuel
+	// Program input and REPL lines share the same reader
+	in := bufio.NewReader(os.Stdin)
+	out := &lineWriter{w: os.Stdout, newline: true}
+	opts.IO = vm2.NewStreamIO(in, out)
+	s := &repl{opts: opts, in: in, out: out}
+	if err = s.reset(); err != nil {
+		log.Fatalln(err.Error())
+	}
+	if pf.src != "" {
+		s.load(pf.src)
+	}
+	s.loop()
+}
+
+func (s *repl) loop() {
+	for {
+		s.printf("false> ")
+		src, ok := s.read()
+		if !ok {
+			s.printf("\n")
+			return
+		}
+		if cmd := strings.Fields(src); len(cmd) > 0 && strings.HasPrefix(cmd[0], ":") {
+			if quit := s.exec(cmd[0], cmd[1:]); quit {
+				return
+			}
+			continue
+		}
+		if strings.TrimSpace(src) != "" {
+			s.run(strings.NewReader(src))
+		}
+	}
+}
+
+// read Read the input line, lines are joined while lambda, string or comment is not closed
+func (s *repl) read() (string, bool) {
+	src := ""
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil && line == "" {
+			return src, src != ""
+		}
+		src += line
+		if !false2.Incomplete(src) {
+			return src, true
+		}
+		s.printf("...... ")
+	}
+}
+
+func (s *repl) exec(cmd string, args []string) bool {
+	switch cmd {
+	case ":stack":
+		for i, v := range s.vm.OpStack.Top(s.vm.OpStack.Len()) {
+			s.printf("%d: %d\n", i, v)
+		}
+	case ":reset":
+		if err := s.reset(); err != nil {
+			s.printf("%s\n", err.Error())
+		}
+	case ":dis":
+		if err := vm2.WriteListing(s.out, s.image()); err != nil {
+			s.printf("%s\n", err.Error())
+		}
+	case ":load":
+		if len(args) == 0 {
+			s.printf("file is required\n")
+			return false
+		}
+		s.load(args[0])
+	case ":help":
+		s.printf(replHelp)
+	case ":quit":
+		return true
+	default:
+		s.printf("unknown command: %s, type :help to list commands\n", cmd)
+	}
+	return false
+}
+
+// reset Create the new VM without code
+func (s *repl) reset() error {
+	prog := &engine.Program{Image: &vm2.Image{}}
+	v, err := prog.NewVM(s.opts)
+	if err != nil {
+		return err
+	}
+	s.vm = v
+	s.next = 0
+	s.vars = v.OpStack.Offset - false2.VarsCount
+	if s.vars < 0 {
+		return errors.New("memory is too small for variables")
+	}
+	s.instrs = nil
+	s.relocs = nil
+	s.symbols = make(map[int]string)
+	return nil
+}
+
+func (s *repl) load(file string) {
+	r, err := engine.OpenSource(file)
+	if err != nil {
+		s.printf("%s\n", err.Error())
+		return
+	}
+	defer r.Close()
+	s.run(r)
+}
+
+// run Compile the source after the entered code and run it, the op stack is printed after that
+func (s *repl) run(r io.Reader) {
+	img, err := false2.CompileFragment(r, s.next, s.vars)
+	if err != nil {
+		var ce *input.Error
+		if errors.As(err, &ce) {
+			_ = input.Render(s.out, ce.Diagnostics)
+		} else {
+			s.printf("%s\n", err.Error())
+		}
+		return
+	}
+	if s.next+len(img.Code) > s.vars {
+		s.printf("out of program memory, type :reset to start over\n")
+		return
+	}
+	copy(s.vm.Memory[s.next:], img.Code)
+	s.next += len(img.Code)
+	s.instrs = append(s.instrs, img.Instrs...)
+	s.relocs = append(s.relocs, img.Relocs...)
+	for a, name := range img.Symbols {
+		s.symbols[a] = name
+	}
+
+	s.vm.CallStack.Reset()
+	s.out.newline = true
+	if err = s.vm.SetIP(img.Entry); err == nil {
+		err = s.vm.RunContext(context.Background(), s.opts.Limits())
+	}
+	if !s.out.newline {
+		s.printf("\n")
+	}
+	if err != nil {
+		s.printf("fault: %s\n", err.Error())
+	}
+	s.printStack()
+}
+
+// image Image of the entered code for listing
+func (s *repl) image() *vm2.Image {
+	return &vm2.Image{
+		Code:    s.vm.Memory[:s.next],
+		Symbols: s.symbols,
+		Instrs:  s.instrs,
+		Relocs:  s.relocs,
+	}
+}
+
+// printStack Print the op stack bottom first with its depth, like Forth .s word
+func (s *repl) printStack() {
+	top := s.vm.OpStack.Top(s.vm.OpStack.Len())
+	items := make([]string, 0, len(top))
+	for i := len(top) - 1; i >= 0; i-- {
+		items = append(items, fmt.Sprint(top[i]))
+	}
+	s.printf("<%d> %s\n", len(top), strings.Join(items, " "))
+}
+
+func (s *repl) printf(format string, a ...any) {
+	_, _ = fmt.Fprintf(s.out, format, a...)
+}
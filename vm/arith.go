@@ -0,0 +1,130 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+)
+
+// ArithMode Behavior of arithmetic instructions on 32-bit overflow
+type ArithMode int
+
+const (
+	// ArithWrap Wrap around 32-bit two's complement
+	ArithWrap ArithMode = iota
+	// ArithSaturate Clamp result to the 32-bit range
+	ArithSaturate
+	// ArithTrap Fault with ErrOverflow
+	ArithTrap
+)
+
+var arithModes = map[string]ArithMode{
+	"wrap":     ArithWrap,
+	"saturate": ArithSaturate,
+	"trap":     ArithTrap,
+}
+
+func (m ArithMode) String() string {
+	for s, v := range arithModes {
+		if v == m {
+			return s
+		}
+	}
+	return "unknown"
+}
+
+func ParseArithMode(s string) (ArithMode, error) {
+	if m, ok := arithModes[s]; ok {
+		return m, nil
+	}
+	return 0, fmt.Errorf("unknown arithmetic mode: %s", s)
+}
+
+// DivZeroMode Behavior of Divide and Mod instructions on zero divisor
+type DivZeroMode int
+
+const (
+	// DivZeroFault Fault with ErrDivideByZero
+	DivZeroFault DivZeroMode = iota
+	// DivZeroYield Push zero as the result
+	DivZeroYield
+)
+
+var divZeroModes = map[string]DivZeroMode{
+	"fault": DivZeroFault,
+	"zero":  DivZeroYield,
+}
+
+func (m DivZeroMode) String() string {
+	for s, v := range divZeroModes {
+		if v == m {
+			return s
+		}
+	}
+	return "unknown"
+}
+
+func ParseDivZeroMode(s string) (DivZeroMode, error) {
+	if m, ok := divZeroModes[s]; ok {
+		return m, nil
+	}
+	return 0, fmt.Errorf("unknown division by zero mode: %s", s)
+}
+
+// arith Fit 64-bit result of 32-bit operands into 32-bit according to the arithmetic mode
+func (vm *VM) arith(v int64) (int, error) {
+	if v >= math.MinInt32 && v <= math.MaxInt32 {
+		return int(v), nil
+	}
+	switch vm.Arith {
+	case ArithSaturate:
+		if v < 0 {
+			return math.MinInt32, nil
+		}
+		return math.MaxInt32, nil
+	case ArithTrap:
+		return 0, ErrOverflow
+	default:
+		return int(int32(v)), nil
+	}
+}
+
+func (vm *VM) plus(a int, b int) (int, error) {
+	return vm.arith(int64(a) + int64(b))
+}
+
+func (vm *VM) minus(a int, b int) (int, error) {
+	return vm.arith(int64(a) - int64(b))
+}
+
+func (vm *VM) multiply(a int, b int) (int, error) {
+	return vm.arith(int64(a) * int64(b))
+}
+
+func (vm *VM) divide(a int, b int) (int, error) {
+	if b == 0 {
+		if vm.DivZero == DivZeroYield {
+			return 0, nil
+		}
+		return 0, ErrDivideByZero
+	}
+	return vm.arith(int64(a) / int64(b))
+}
+
+// mod Floored modulo, the result has the sign of the divisor
+func (vm *VM) mod(a int, b int) (int, error) {
+	if b == 0 {
+		if vm.DivZero == DivZeroYield {
+			return 0, nil
+		}
+		return 0, ErrDivideByZero
+	}
+	r := int64(a) % int64(b)
+	if r != 0 && (r < 0) != (b < 0) {
+		r += int64(b)
+	}
+	return vm.arith(r)
+}
+
+func (vm *VM) negative(a int) (int, error) {
+	return vm.arith(-int64(a))
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strconv"
 )
 
 const (
@@ -47,40 +48,113 @@ const (
 	InstrGotoIf int = 29
 
 	InstrEnd int = 30
+
+	InstrStoreI int = 31
+	InstrFetchI int = 32
+
+	InstrMod int = 33
+
+	InstrBitAnd int = 34
+	InstrBitOr  int = 35
+	InstrBitNot int = 36
 )
 
-type BufferWrapper struct {
-	buf          *bytes.Buffer
-	prevLenBytes int
+type InstrInfo struct {
+	Name string
+	Args int
+	// Pop, Push Number of stack items taken and put by the instruction (items taken by the called sub are not counted)
+	Pop  int
+	Push int
 }
 
-type BytecodeWriter struct {
-	order binary.ByteOrder
-	buffs *Stack
+// Instructions Mnemonic, immediate arguments count and stack effect of every instruction
+// (WriteStr has 1 length argument followed by that many chars)
+var Instructions = map[int]InstrInfo{
+	InstrPush:      {"Push", 1, 0, 1},
+	InstrDup:       {"Dup", 0, 1, 2},
+	InstrDrop:      {"Drop", 0, 1, 0},
+	InstrSwap:      {"Swap", 0, 2, 2},
+	InstrRot:       {"Rot", 0, 3, 3},
+	InstrPick:      {"Pick", 0, 1, 1},
+	InstrPlus:      {"Plus", 0, 2, 1},
+	InstrMinus:     {"Minus", 0, 2, 1},
+	InstrMultiply:  {"Multiply", 0, 2, 1},
+	InstrDivide:    {"Divide", 0, 2, 1},
+	InstrNegative:  {"Negative", 0, 1, 1},
+	InstrAnd:       {"And", 0, 2, 1},
+	InstrOr:        {"Or", 0, 2, 1},
+	InstrNot:       {"Not", 0, 1, 1},
+	InstrMore:      {"More", 0, 2, 1},
+	InstrEquals:    {"Equals", 0, 2, 1},
+	InstrReadChar:  {"ReadChar", 0, 0, 1},
+	InstrWriteChar: {"WriteChar", 0, 1, 0},
+	InstrWriteInt:  {"WriteInt", 0, 1, 0},
+	InstrWriteStr:  {"WriteStr", 1, 0, 0},
+	InstrFlush:     {"Flush", 0, 0, 0},
+	InstrStore:     {"Store", 1, 1, 0},
+	InstrFetch:     {"Fetch", 1, 0, 1},
+	InstrCopy:      {"Copy", 2, 0, 0},
+	InstrCall:      {"Call", 0, 1, 0},
+	InstrCallIf:    {"CallIf", 0, 2, 0},
+	InstrReturn:    {"Return", 0, 0, 0},
+	InstrGoto:      {"Goto", 1, 0, 0},
+	InstrGotoIf:    {"GotoIf", 0, 2, 0},
+	InstrEnd:       {"End", 0, 0, 0},
+	InstrStoreI:    {"StoreI", 0, 2, 0},
+	InstrFetchI:    {"FetchI", 0, 1, 1},
+	InstrMod:       {"Mod", 0, 2, 1},
+	InstrBitAnd:    {"BitAnd", 0, 2, 1},
+	InstrBitOr:     {"BitOr", 0, 2, 1},
+	InstrBitNot:    {"BitNot", 0, 1, 1},
 }
 
-func NewBytecodeWriter() *BytecodeWriter {
-	buffs := NewStack()
-	buffs.Push(&BufferWrapper{buf: new(bytes.Buffer), prevLenBytes: 0})
-	return &BytecodeWriter{
-		order: binary.LittleEndian,
-		buffs: buffs,
+// InstrName Mnemonic of the instruction or its code if it is unknown
+func InstrName(i int) string {
+	if info, ok := Instructions[i]; ok {
+		return info.Name
 	}
+	if i == OpFetch {
+		return "<fetch>"
+	}
+	return strconv.Itoa(i)
 }
 
-func (w *BytecodeWriter) bufWrap() *BufferWrapper {
-	if w.buffs.Len() > 0 {
-		return w.buffs.Peek().(*BufferWrapper)
-	}
-	return nil
+// Label Forward or backward reference to a code address, bound by BytecodeWriter.Bind
+type Label int
+
+// fixup Word at the address to be patched with the label address
+type fixup struct {
+	addr  int
+	label Label
 }
 
-func (w *BytecodeWriter) buf() *bytes.Buffer {
-	bw := w.bufWrap()
-	if bw != nil {
-		return bw.buf
+// block Pending sub or block, code between start and end labels is skipped by goto
+type block struct {
+	start Label
+	end   Label
+}
+
+type BytecodeWriter struct {
+	order     binary.ByteOrder
+	buf       *bytes.Buffer
+	labels    []int
+	fixups    []fixup
+	blocks    *Stack
+	err       error
+	symbols   map[int]string
+	sourceMap *SourceMap
+	// instrs Instruction start addresses
+	instrs []int
+	// relocs Addresses of words holding code or data addresses
+	relocs []int
+}
+
+func NewBytecodeWriter() *BytecodeWriter {
+	return &BytecodeWriter{
+		order:  binary.LittleEndian,
+		buf:    new(bytes.Buffer),
+		blocks: NewStack(),
 	}
-	return nil
 }
 
 func (w *BytecodeWriter) Len() int {
@@ -88,8 +162,53 @@ func (w *BytecodeWriter) Len() int {
 }
 
 func (w *BytecodeWriter) LenBytes() int {
-	bw := w.bufWrap()
-	return bw.prevLenBytes + bw.buf.Len()
+	return w.buf.Len()
+}
+
+// NewLabel Create unbound label
+func (w *BytecodeWriter) NewLabel() Label {
+	w.labels = append(w.labels, -1)
+	return Label(len(w.labels) - 1)
+}
+
+// Bind Bind the label to the current address and patch words written for it before
+func (w *BytecodeWriter) Bind(l Label) {
+	if w.labels[l] >= 0 {
+		w.fail(fmt.Errorf("label %d is bound twice", l))
+		return
+	}
+	w.labels[l] = w.Len()
+	fixups := w.fixups[:0]
+	for _, f := range w.fixups {
+		if f.label == l {
+			w.patch(f.addr, w.labels[l])
+		} else {
+			fixups = append(fixups, f)
+		}
+	}
+	w.fixups = fixups
+}
+
+// LabelAddr Address of the label, false if it is not bound yet
+func (w *BytecodeWriter) LabelAddr(l Label) (int, bool) {
+	addr := w.labels[l]
+	return addr, addr >= 0
+}
+
+// WriteIntLabel Write address of the label, unbound label is written as placeholder and patched on Bind
+func (w *BytecodeWriter) WriteIntLabel(l Label) {
+	if addr, ok := w.LabelAddr(l); ok {
+		w.WriteAddr(addr)
+		return
+	}
+	w.fixups = append(w.fixups, fixup{addr: w.Len(), label: l})
+	w.WriteAddr(0)
+}
+
+// WriteAddr Write code or data address, it is relocated when the code is optimized
+func (w *BytecodeWriter) WriteAddr(addr int) {
+	w.relocs = append(w.relocs, w.Len())
+	w.WriteInt(addr)
 }
 
 func (w *BytecodeWriter) WritePush(v int) {
@@ -97,9 +216,24 @@ func (w *BytecodeWriter) WritePush(v int) {
 	w.WriteInt(v)
 }
 
+func (w *BytecodeWriter) WritePushAddr(addr int) {
+	w.WriteCommand(InstrPush)
+	w.WriteAddr(addr)
+}
+
+func (w *BytecodeWriter) WritePushLabel(l Label) {
+	w.WriteCommand(InstrPush)
+	w.WriteIntLabel(l)
+}
+
 func (w *BytecodeWriter) WriteGoto(addr int) {
 	w.WriteCommand(InstrGoto)
-	w.WriteInt(addr)
+	w.WriteAddr(addr)
+}
+
+func (w *BytecodeWriter) WriteGotoLabel(l Label) {
+	w.WriteCommand(InstrGoto)
+	w.WriteIntLabel(l)
 }
 
 func (w *BytecodeWriter) WriteGotoIf() {
@@ -109,24 +243,34 @@ func (w *BytecodeWriter) WriteGotoIf() {
 func (w *BytecodeWriter) WriteGotoRel(diff int) int {
 	w.WriteCommand(InstrGoto)
 	addr := w.Len() + 1 + diff
-	w.WriteInt(addr)
+	w.WriteAddr(addr)
 	return addr
 }
 
 func (w *BytecodeWriter) WriteStore(addr int) {
 	w.WriteCommand(InstrStore)
-	w.WriteInt(addr)
+	w.WriteAddr(addr)
+}
+
+func (w *BytecodeWriter) WriteStoreLabel(l Label) {
+	w.WriteCommand(InstrStore)
+	w.WriteIntLabel(l)
 }
 
 func (w *BytecodeWriter) WriteFetch(addr int) {
 	w.WriteCommand(InstrFetch)
-	w.WriteInt(addr)
+	w.WriteAddr(addr)
+}
+
+func (w *BytecodeWriter) WriteFetchLabel(l Label) {
+	w.WriteCommand(InstrFetch)
+	w.WriteIntLabel(l)
 }
 
 func (w *BytecodeWriter) WriteCopy(addr1 int, addr2 int) {
 	w.WriteCommand(InstrCopy)
-	w.WriteInt(addr1)
-	w.WriteInt(addr2)
+	w.WriteAddr(addr1)
+	w.WriteAddr(addr2)
 }
 
 func (w *BytecodeWriter) WriteCall() {
@@ -157,63 +301,137 @@ func (w *BytecodeWriter) WriteVar(v int) int {
 	return addr
 }
 
+// WriteVarAddr Write variable holding code or data address
+func (w *BytecodeWriter) WriteVarAddr(addr int) int {
+	w.WriteGotoRel(1)
+	v := w.Len()
+	w.WriteAddr(addr)
+	return v
+}
+
+// BlockCreate Start code skipped by goto, it may be called or used as data
 func (w *BytecodeWriter) BlockCreate() {
-	w.buffs.Push(&BufferWrapper{buf: new(bytes.Buffer), prevLenBytes: w.LenBytes() + 8}) // TODO: check +8
+	b := block{start: w.NewLabel(), end: w.NewLabel()}
+	w.WriteGotoLabel(b.end) // Goto address to skip block
+	w.Bind(b.start)
+	w.blocks.Push(b)
 }
 
+// BlockSkip End block, returns its start address
 func (w *BytecodeWriter) BlockSkip() (int, error) {
-	bw := w.buffs.Pop().(*BufferWrapper)
-	buf := bw.buf
-	if buf == nil {
+	b, ok := w.blocks.Pop().(block)
+	if !ok {
 		return 0, fmt.Errorf("block end without creation")
 	}
-	w.WriteGotoRel(buf.Len() / 4) // Goto address to skip sub
-	addr := w.Len()
-	w.WriteBytes(buf.Bytes()) // Write sub content
-	buf.Reset()
+	w.Bind(b.end)
+	addr, _ := w.LabelAddr(b.start)
 	return addr, nil
 }
 
+// SubCreate Start sub, it is skipped by goto
 func (w *BytecodeWriter) SubCreate() {
-	w.buffs.Push(&BufferWrapper{buf: new(bytes.Buffer), prevLenBytes: w.LenBytes() + 8}) // TODO: check +8
+	w.BlockCreate()
 }
 
+// SubReturn End sub and push its start address to stack
 func (w *BytecodeWriter) SubReturn() error {
-	w.WriteCommand(InstrReturn)
-	bw := w.buffs.Pop().(*BufferWrapper)
-	buf := bw.buf
-	if buf == nil {
+	b, ok := w.blocks.Pop().(block)
+	if !ok {
 		return fmt.Errorf("sub return without creation")
 	}
-	w.WriteGotoRel(buf.Len() / 4) // Goto address to skip sub
-	addr := w.Len()               // Sub start address
-	w.WriteBytes(buf.Bytes())     // Write sub content
-	w.WritePush(addr)             // Push sub start point to stack
-	buf.Reset()
+	w.WriteCommand(InstrReturn)
+	w.Bind(b.end)
+	w.WritePushLabel(b.start) // Push sub start point to stack
 	return nil
 }
 
 func (w *BytecodeWriter) WriteCommand(c int) {
+	w.instrs = append(w.instrs, w.Len())
 	w.WriteInt(c)
 }
 
 func (w *BytecodeWriter) WriteInt(v int) {
-	err := binary.Write(w.buf(), w.order, int32(v))
+	err := binary.Write(w.buf, w.order, int32(v))
 	w.assertError(err)
 }
 
 func (w *BytecodeWriter) WriteBytes(p []byte) {
-	_, err := w.buf().Write(p)
+	_, err := w.buf.Write(p)
 	w.assertError(err)
 }
 
+func (w *BytecodeWriter) patch(addr int, v int) {
+	w.order.PutUint32(w.buf.Bytes()[addr*4:], uint32(int32(v)))
+}
+
+// fail Keep the first error, it is returned on image creation
+func (w *BytecodeWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Resolve Check all labels are bound and all blocks are closed
+func (w *BytecodeWriter) Resolve() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.fixups) > 0 {
+		f := w.fixups[0]
+		return fmt.Errorf("label %d is not bound, referenced at address %d", f.label, f.addr)
+	}
+	if w.blocks.Len() > 0 {
+		return fmt.Errorf("block is not closed")
+	}
+	return nil
+}
+
+// AddSymbol Name the address (label, variable) in the image symbols section
+func (w *BytecodeWriter) AddSymbol(addr int, name string) {
+	if w.symbols == nil {
+		w.symbols = make(map[int]string)
+	}
+	w.symbols[addr] = name
+}
+
+// SetSourcePos Map code written next to the source position
+func (w *BytecodeWriter) SetSourcePos(line int, col int) {
+	if w.sourceMap == nil {
+		w.sourceMap = &SourceMap{}
+	}
+	w.sourceMap.Add(w.Len(), line, col)
+}
+
+// Bytes Code without container, placeholders of unbound labels are zero
 func (w *BytecodeWriter) Bytes() []byte {
-	return w.buf().Bytes()
+	return w.buf.Bytes()
+}
+
+func (w *BytecodeWriter) Image() (*Image, error) {
+	if err := w.Resolve(); err != nil {
+		return nil, err
+	}
+	code, err := decodeWords(w.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &Image{
+		Version:   ImageVersion,
+		Code:      code,
+		SourceMap: w.sourceMap,
+		Symbols:   w.symbols,
+		Instrs:    w.instrs,
+		Relocs:    w.relocs,
+	}, nil
 }
 
+// WriteTo Write code in the container format
 func (w *BytecodeWriter) WriteTo(out io.Writer) (int64, error) {
-	img := w.buf().Bytes()
-	n, err := out.Write(img)
+	img, err := w.Image()
+	if err != nil {
+		return 0, err
+	}
+	n, err := out.Write(img.Encode())
 	return int64(n), err
 }
 
@@ -0,0 +1,108 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBytecodeWriter_Labels(t *testing.T) {
+	tests := []struct {
+		name    string
+		write   func(w *BytecodeWriter)
+		want    []int
+		wantErr bool
+	}{
+		{
+			name: "check forward goto",
+			write: func(w *BytecodeWriter) {
+				l := w.NewLabel()
+				w.WriteGotoLabel(l)
+				w.WriteCommand(InstrDup)
+				w.Bind(l)
+				w.WriteEnd()
+			},
+			want: []int{InstrGoto, 3, InstrDup, InstrEnd},
+		},
+		{
+			name: "check backward push",
+			write: func(w *BytecodeWriter) {
+				l := w.NewLabel()
+				w.WriteCommand(InstrDup)
+				w.Bind(l)
+				w.WritePushLabel(l)
+				w.WriteGotoIf()
+			},
+			want: []int{InstrDup, InstrPush, 1, InstrGotoIf},
+		},
+		{
+			name: "check placeholder patched by store",
+			write: func(w *BytecodeWriter) {
+				l := w.NewLabel()
+				w.WriteStoreLabel(l)
+				w.WriteFetchLabel(l)
+				w.WriteCommand(InstrFetch)
+				w.Bind(l)
+				w.WriteInt(0)
+			},
+			want: []int{InstrStore, 5, InstrFetch, 5, InstrFetch, 0},
+		},
+		{
+			name: "check sub",
+			write: func(w *BytecodeWriter) {
+				w.SubCreate()
+				w.WriteCommand(InstrDup)
+				_ = w.SubReturn()
+				w.WriteCall()
+			},
+			want: []int{InstrGoto, 4, InstrDup, InstrReturn, InstrPush, 2, InstrCall},
+		},
+		{
+			name: "check unbound label",
+			write: func(w *BytecodeWriter) {
+				w.WriteGotoLabel(w.NewLabel())
+			},
+			wantErr: true,
+		},
+		{
+			name: "check label bound twice",
+			write: func(w *BytecodeWriter) {
+				l := w.NewLabel()
+				w.Bind(l)
+				w.WriteEnd()
+				w.Bind(l)
+			},
+			wantErr: true,
+		},
+		{
+			name: "check unclosed block",
+			write: func(w *BytecodeWriter) {
+				w.BlockCreate()
+				w.WriteEnd()
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewBytecodeWriter()
+			tt.write(w)
+			img, err := w.Image()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Image() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(img.Code, tt.want) {
+				t.Errorf("Image() got = %v, want %v", img.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestBytecodeWriter_SubReturn(t *testing.T) {
+	if err := NewBytecodeWriter().SubReturn(); err == nil {
+		t.Errorf("SubReturn() without SubCreate error = nil")
+	}
+}
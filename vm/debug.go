@@ -0,0 +1,160 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+)
+
+var ErrHalted = errors.New("program halted")
+
+type EventKind int
+
+const (
+	EventHalt EventKind = iota
+	EventBreakpoint
+	EventWatchpoint
+)
+
+// Event Reason of the debugger stop
+type Event struct {
+	Kind EventKind
+	IP   int
+	// Addr, Old and New Written memory cell and its values (watchpoints only)
+	Addr int
+	Old  int
+	New  int
+}
+
+// IP Address of the next instruction
+func (vm *VM) IP() int {
+	return vm.ip
+}
+
+// SetIP Move instruction pointer to the address
+func (vm *VM) SetIP(addr int) error {
+	if addr < 0 || addr >= len(vm.Memory) {
+		return ErrOutOfBounds
+	}
+	vm.ip = addr
+	vm.halted = false
+	return nil
+}
+
+func (vm *VM) Halted() bool {
+	return vm.halted
+}
+
+func (vm *VM) SetBreakpoint(addr int) {
+	if vm.breakpoints == nil {
+		vm.breakpoints = make(map[int]bool)
+	}
+	vm.breakpoints[addr] = true
+}
+
+func (vm *VM) ClearBreakpoint(addr int) {
+	delete(vm.breakpoints, addr)
+}
+
+func (vm *VM) Breakpoints() []int {
+	return sortedKeys(vm.breakpoints)
+}
+
+// Watch Stop when the memory cell is written by Store or Copy instruction
+func (vm *VM) Watch(addr int) {
+	if vm.watchpoints == nil {
+		vm.watchpoints = make(map[int]bool)
+	}
+	vm.watchpoints[addr] = true
+}
+
+func (vm *VM) Unwatch(addr int) {
+	delete(vm.watchpoints, addr)
+}
+
+func (vm *VM) Watchpoints() []int {
+	return sortedKeys(vm.watchpoints)
+}
+
+// Backtrace Return addresses from the call stack, innermost first
+func (vm *VM) Backtrace() []int {
+	return vm.CallStack.Top(vm.CallStack.Len())
+}
+
+// Step Execute single instruction, event is returned on watchpoint hit or program halt
+func (vm *VM) Step() (*Event, error) {
+	if vm.halted {
+		return nil, ErrHalted
+	}
+	if vm.IO == nil {
+		vm.IO = NewStreamIO(os.Stdin, os.Stdout)
+	}
+	ip := vm.ip
+	vm.event = nil
+	if err := vm.exec(); err != nil {
+		return nil, err
+	}
+	if vm.halted {
+		return &Event{Kind: EventHalt, IP: vm.ip}, nil
+	}
+	if vm.event != nil {
+		// Watchpoint is reported at the instruction wrote the cell
+		vm.event.IP = ip
+	}
+	return vm.event, nil
+}
+
+// Continue Execute instructions until breakpoint, watchpoint, program halt or fault
+func (vm *VM) Continue(ctx context.Context) (*Event, error) {
+	first := true
+	for n := 0; ; n++ {
+		if !first && vm.breakpoints[vm.ip] {
+			return &Event{Kind: EventBreakpoint, IP: vm.ip}, nil
+		}
+		first = false
+		if n%defaultCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, &CancelError{IP: vm.ip, Err: err}
+			}
+		}
+		if e, err := vm.Step(); e != nil || err != nil {
+			return e, err
+		}
+	}
+}
+
+// StepOver Execute single instruction, running called sub to its return
+func (vm *VM) StepOver(ctx context.Context) (*Event, error) {
+	depth := vm.CallStack.Len()
+	e, err := vm.Step()
+	for n := 1; e == nil && err == nil && vm.CallStack.Len() > depth; n++ {
+		if vm.breakpoints[vm.ip] {
+			return &Event{Kind: EventBreakpoint, IP: vm.ip}, nil
+		}
+		if n%defaultCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return nil, &CancelError{IP: vm.ip, Err: err}
+			}
+		}
+		e, err = vm.Step()
+	}
+	return e, err
+}
+
+// store Write memory cell, noticing watchpoints
+func (vm *VM) store(addr int, v int) {
+	if vm.watchpoints != nil && vm.watchpoints[addr] {
+		vm.event = &Event{Kind: EventWatchpoint, Addr: addr, Old: vm.Memory[addr], New: v}
+	}
+	vm.Memory[addr] = v
+}
+
+func sortedKeys(m map[int]bool) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
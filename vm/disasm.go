@@ -0,0 +1,280 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	listingDataPerLine = 8
+	listingZeroRun     = 4
+)
+
+// Instruction Decoded instruction or inline data
+type Instruction struct {
+	Addr int
+	Op   int
+	Args []int
+	// Data Args hold inline data words instead of the instruction
+	Data bool
+}
+
+// Len Number of words occupied by the instruction
+func (in Instruction) Len() int {
+	if in.Data {
+		return len(in.Args)
+	}
+	return 1 + len(in.Args)
+}
+
+func (in Instruction) String() string {
+	if in.Data {
+		return ".data" + formatInts(in.Args, " ", " ")
+	}
+	if in.Op == InstrWriteStr {
+		if s, ok := writeStrPayload(in.Args); ok {
+			return InstrName(in.Op) + " " + strconv.Quote(s)
+		}
+	}
+	return InstrName(in.Op) + formatInts(in.Args, " ", " ")
+}
+
+// DecodeInstruction Decode single instruction at the address, unknown or truncated instruction is decoded as data word
+func DecodeInstruction(img []int, addr int) Instruction {
+	return decodeInstruction(img, addr, len(img))
+}
+
+func decodeInstruction(img []int, addr int, end int) Instruction {
+	op := img[addr]
+	info, ok := Instructions[op]
+	if !ok {
+		return Instruction{Addr: addr, Args: []int{op}, Data: true}
+	}
+	n := info.Args
+	if op == InstrWriteStr && addr+1 < end {
+		n += img[addr+1]
+	}
+	if n < 0 || addr+1+n > end {
+		return Instruction{Addr: addr, Args: []int{op}, Data: true}
+	}
+	return Instruction{Addr: addr, Op: op, Args: append([]int(nil), img[addr+1:addr+1+n]...)}
+}
+
+// region Words skipped by forward Goto, either a sub body or inline data
+type region struct {
+	start int
+	end   int
+}
+
+// Disassemble Decode image to instructions, marking inline data (variables, BF tape) which is skipped by Goto
+// and never referenced as code by Push or Goto
+func Disassemble(img []int) []Instruction {
+	var regions []region
+	code := decodeRange(img, 0, len(img), &regions)
+
+	refs := make(map[int]bool)
+	for _, in := range code {
+		if !in.Data && (in.Op == InstrPush || in.Op == InstrGoto) {
+			refs[in.Args[0]] = true
+		}
+	}
+
+	data := make(map[int]region)
+	for _, r := range regions {
+		if !refs[r.start] {
+			data[r.start] = r
+		}
+	}
+
+	res := make([]Instruction, 0, len(code))
+	for i := 0; i < len(code); i++ {
+		in := code[i]
+		if r, ok := data[in.Addr]; ok {
+			res = append(res, Instruction{Addr: r.start, Args: append([]int(nil), img[r.start:r.end]...), Data: true})
+			for i+1 < len(code) && code[i+1].Addr < r.end {
+				i++
+			}
+			continue
+		}
+		res = append(res, in)
+	}
+	return res
+}
+
+func decodeRange(img []int, from int, to int, regions *[]region) []Instruction {
+	var res []Instruction
+	for addr := from; addr < to; {
+		in := decodeInstruction(img, addr, to)
+		res = append(res, in)
+		addr += in.Len()
+		if !in.Data && in.Op == InstrGoto {
+			if t := in.Args[0]; t > addr && t <= to {
+				*regions = append(*regions, region{start: addr, end: t})
+				res = append(res, decodeRange(img, addr, t, regions)...)
+				addr = t
+			}
+		}
+	}
+	return res
+}
+
+// WriteListing Write assembly listing of the image: symbols are used as labels, other code labels are prefixed
+// with L, data labels with D, addresses are written in comments
+func WriteListing(w io.Writer, img *Image) error {
+	code := Disassemble(img.Code)
+
+	labels := make(map[int]string)
+	starts := make(map[int]bool)
+	// Sub and block starts, which are skipped by the previous Goto
+	subs := make(map[int]bool)
+	for i, in := range code {
+		starts[in.Addr] = in.Data
+		if i > 0 && !in.Data {
+			prev := code[i-1]
+			subs[in.Addr] = !prev.Data && prev.Op == InstrGoto && prev.Addr+2 == in.Addr
+		}
+	}
+	label := func(addr int, prefix string) {
+		if name, ok := img.Symbols[addr]; ok {
+			labels[addr] = name
+		} else {
+			labels[addr] = fmt.Sprintf("%s%04d", prefix, addr)
+		}
+	}
+	for addr := range img.Symbols {
+		// Symbols out of the code name operands only, e.g. variables placed in the free memory
+		if _, ok := starts[addr]; ok || addr < 0 || addr >= len(img.Code) {
+			label(addr, "")
+		}
+	}
+	for _, in := range code {
+		if in.Data {
+			continue
+		}
+		switch in.Op {
+		case InstrGoto:
+			if isData, ok := starts[in.Args[0]]; ok && !isData {
+				label(in.Args[0], "L")
+			}
+		case InstrPush:
+			if subs[in.Args[0]] {
+				label(in.Args[0], "L")
+			}
+		case InstrStore, InstrFetch, InstrCopy:
+			for _, a := range in.Args {
+				if isData, ok := starts[a]; ok && isData {
+					label(a, "D")
+				}
+			}
+		}
+	}
+
+	var lastPos SourcePos
+	for _, in := range code {
+		// Source position is noted on the instruction lines where it changes
+		src := ""
+		if pos, ok := img.SourceMap.Lookup(in.Addr); ok && !in.Data && pos != lastPos {
+			src = " " + img.SourceMap.Format(in.Addr)
+			lastPos = pos
+		}
+		var lines []listingLine
+		if in.Data {
+			lines = formatData(in.Args)
+		} else {
+			lines = []listingLine{{text: formatInstruction(in, labels)}}
+		}
+		addr := in.Addr
+		for i, line := range lines {
+			label := ""
+			if i == 0 {
+				if l, ok := labels[in.Addr]; ok {
+					label = l + ":"
+				}
+			}
+			if _, err := fmt.Fprintf(w, "%-7s %-32s; %04d%s\n", label, line.text, addr, src); err != nil {
+				return err
+			}
+			addr += line.words
+		}
+	}
+	return nil
+}
+
+func formatInstruction(in Instruction, labels map[int]string) string {
+	name := fmt.Sprintf("%-10s", InstrName(in.Op))
+	switch in.Op {
+	case InstrWriteStr:
+		if s, ok := writeStrPayload(in.Args); ok {
+			return name + strconv.Quote(s)
+		}
+	case InstrPush:
+		if l, ok := labels[in.Args[0]]; ok {
+			return name + l
+		}
+	case InstrGoto, InstrStore, InstrFetch, InstrCopy:
+		args := make([]string, len(in.Args))
+		for i, a := range in.Args {
+			if l, ok := labels[a]; ok {
+				args[i] = l
+			} else {
+				args[i] = strconv.Itoa(a)
+			}
+		}
+		return name + strings.Join(args, " ")
+	}
+	return strings.TrimRight(name+formatInts(in.Args, "", " "), " ")
+}
+
+type listingLine struct {
+	text  string
+	words int
+}
+
+// formatData Render data words as .data directives, long zero runs as .zero
+func formatData(words []int) []listingLine {
+	var lines []listingLine
+	var cur []int
+	flush := func() {
+		if len(cur) > 0 {
+			lines = append(lines, listingLine{text: ".data     " + formatInts(cur, "", " "), words: len(cur)})
+			cur = nil
+		}
+	}
+	for i := 0; i < len(words); {
+		z := i
+		for z < len(words) && words[z] == 0 {
+			z++
+		}
+		if z-i >= listingZeroRun {
+			flush()
+			lines = append(lines, listingLine{text: fmt.Sprintf(".zero     %d", z-i), words: z - i})
+			i = z
+			continue
+		}
+		cur = append(cur, words[i])
+		if len(cur) == listingDataPerLine {
+			flush()
+		}
+		i++
+	}
+	flush()
+	return lines
+}
+
+// writeStrPayload Decode WriteStr arguments (length followed by chars) to string if it is printable back
+func writeStrPayload(args []int) (string, bool) {
+	if len(args) == 0 || args[0] != len(args)-1 {
+		return "", false
+	}
+	b := make([]rune, 0, len(args)-1)
+	for _, c := range args[1:] {
+		if c < 0 || c > 255 || !utf8.ValidRune(rune(c)) {
+			return "", false
+		}
+		b = append(b, rune(c))
+	}
+	return string(b), true
+}
@@ -0,0 +1,81 @@
+package vm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	bc := NewBytecodeWriter()
+	addr := bc.WriteVar(5)
+	bc.SubCreate()
+	bc.WriteString("hi")
+	_ = bc.SubReturn()
+	bc.WriteStore(addr)
+	bc.WriteEnd()
+
+	want := []Instruction{
+		{Addr: 0, Op: InstrGoto, Args: []int{3}},
+		{Addr: 2, Args: []int{5}, Data: true},
+		{Addr: 3, Op: InstrGoto, Args: []int{10}},
+		{Addr: 5, Op: InstrWriteStr, Args: []int{2, 'h', 'i'}},
+		{Addr: 9, Op: InstrReturn},
+		{Addr: 10, Op: InstrPush, Args: []int{5}},
+		{Addr: 12, Op: InstrStore, Args: []int{2}},
+		{Addr: 14, Op: InstrEnd},
+	}
+	if got := Disassemble(image(bc)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Disassemble() = %v, want %v", got, want)
+	}
+}
+
+func TestWriteListing(t *testing.T) {
+	bc := NewBytecodeWriter()
+	addr := bc.WriteVar(5)
+	bc.SubCreate()
+	bc.WriteString("hi\n")
+	_ = bc.SubReturn()
+	bc.WriteStore(addr)
+	bc.WriteEnd()
+
+	want := "        Goto      L0003                 ; 0000\n" +
+		"D0002:  .data     5                     ; 0002\n" +
+		"L0003:  Goto      L0011                 ; 0003\n" +
+		"L0005:  WriteStr  \"hi\\n\"                ; 0005\n" +
+		"        Return                          ; 0010\n" +
+		"L0011:  Push      L0005                 ; 0011\n" +
+		"        Store     D0002                 ; 0013\n" +
+		"        End                             ; 0015\n"
+	w := new(bytes.Buffer)
+	if err := WriteListing(w, &Image{Code: image(bc)}); err != nil {
+		t.Fatalf("WriteListing() error = %v", err)
+	}
+	if got := w.String(); got != want {
+		t.Errorf("WriteListing() got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteListing_Symbols(t *testing.T) {
+	bc := NewBytecodeWriter()
+	addr := bc.WriteVar(0)
+	bc.AddSymbol(addr, "counter")
+	bc.WriteFetch(addr)
+	bc.WriteEnd()
+
+	want := "        Goto      L0003                 ; 0000\n" +
+		"counter: .data     0                     ; 0002\n" +
+		"L0003:  Fetch     counter               ; 0003\n" +
+		"        End                             ; 0005\n"
+	img, err := bc.Image()
+	if err != nil {
+		t.Fatalf("Image() error = %v", err)
+	}
+	w := new(bytes.Buffer)
+	if err = WriteListing(w, img); err != nil {
+		t.Fatalf("WriteListing() error = %v", err)
+	}
+	if got := w.String(); got != want {
+		t.Errorf("WriteListing() got\n%s\nwant\n%s", got, want)
+	}
+}
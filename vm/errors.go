@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Fault kinds, use errors.Is to classify VMFault
+var (
+	ErrStackOverflow      = errors.New("stack overflow")
+	ErrStackUnderflow     = errors.New("stack underflow")
+	ErrOutOfBounds        = errors.New("out of bounds")
+	ErrInvalidInstruction = errors.New("invalid instruction")
+	ErrDivideByZero       = errors.New("divide by zero")
+	ErrOverflow           = errors.New("integer overflow")
+)
+
+// OpFetch Op of the fault raised on fetching the instruction itself, the instruction pointer is out of memory
+const OpFetch = -1
+
+// VMFault Error raised by the instruction at IP
+type VMFault struct {
+	Kind   error
+	IP     int
+	Op     int
+	OpName string
+	// Operands Immediate arguments of the instruction
+	Operands []int
+	// Stack Topmost op stack items at the moment of fault, topmost first
+	Stack     []int
+	CallDepth int
+	// Source Position of the instruction in the source file (file:line:col), empty if it is unknown
+	Source string
+}
+
+func (f *VMFault) Error() string {
+	s := fmt.Sprintf("%v at address %d: %s%s, stack [%s], call depth %d",
+		f.Kind, f.IP, f.OpName, formatInts(f.Operands, " ", " "), formatInts(f.Stack, "", " "), f.CallDepth)
+	if f.Source != "" {
+		s += " (" + f.Source + ")"
+	}
+	return s
+}
+
+func (f *VMFault) Unwrap() error {
+	return f.Kind
+}
+
+func formatInts(v []int, prefix string, sep string) string {
+	s := make([]string, len(v))
+	for i, n := range v {
+		s[i] = fmt.Sprint(n)
+	}
+	if len(s) == 0 {
+		return ""
+	}
+	return prefix + strings.Join(s, sep)
+}
+
+type Budget int
+
+const (
+	BudgetInstructions Budget = iota
+	BudgetTime
+)
+
+func (b Budget) String() string {
+	switch b {
+	case BudgetInstructions:
+		return "instructions"
+	case BudgetTime:
+		return "time"
+	default:
+		return "unknown"
+	}
+}
+
+// BudgetError Execution stopped because instructions or time budget is exhausted
+type BudgetError struct {
+	Budget   Budget
+	IP       int
+	Executed int64
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("%s budget exhausted at address %d after %d instructions", e.Budget, e.IP, e.Executed)
+}
+
+// CancelError Execution stopped because the context is done
+type CancelError struct {
+	IP       int
+	Executed int64
+	Err      error
+}
+
+func (e *CancelError) Error() string {
+	return fmt.Sprintf("execution cancelled at address %d after %d instructions: %v", e.IP, e.Executed, e.Err)
+}
+
+func (e *CancelError) Unwrap() error {
+	return e.Err
+}
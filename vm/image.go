@@ -0,0 +1,280 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// Bytecode container layout, all fields are 32-bit little-endian:
+//
+//	magic "FVMB", version, entry point, memory size, op stack size, call stack size,
+//	language name length and bytes, sections count,
+//	sections (id, payload length in bytes, payload),
+//	CRC32 (IEEE) of all the preceding bytes
+//
+// Sections are code, debug (source map), symbols and relocations (instruction starts and address words).
+// Sizes are zero when not requested. Files without magic are loaded as headerless array of words (version 0).
+const (
+	ImageMagic   = "FVMB"
+	ImageVersion = 1
+)
+
+const (
+	SectionCode    = 1
+	SectionDebug   = 2
+	SectionSymbols = 3
+	SectionRelocs  = 4
+)
+
+type Image struct {
+	Version       int
+	Lang          string
+	Entry         int
+	MemSize       int
+	OpStackSize   int
+	CallStackSize int
+	Code          []int
+	// SourceMap Debug section mapping code to the source positions
+	SourceMap *SourceMap
+	// Symbols Names of addresses (labels, variables)
+	Symbols map[int]string
+	// Instrs, Relocs Instruction start addresses and addresses of words holding addresses, required by optimizer
+	Instrs []int
+	Relocs []int
+}
+
+// Relocate Move the image to run at the base address: address words listed in relocations, entry point,
+// instruction starts, symbols and source map are shifted by base
+func (img *Image) Relocate(base int) {
+	for _, r := range img.Relocs {
+		img.Code[r] += base
+	}
+	img.Entry += base
+	for i := range img.Instrs {
+		img.Instrs[i] += base
+	}
+	for i := range img.Relocs {
+		img.Relocs[i] += base
+	}
+	if img.Symbols != nil {
+		symbols := make(map[int]string, len(img.Symbols))
+		for a, name := range img.Symbols {
+			symbols[a+base] = name
+		}
+		img.Symbols = symbols
+	}
+	if img.SourceMap != nil {
+		for i := range img.SourceMap.entries {
+			img.SourceMap.entries[i].addr += base
+		}
+	}
+}
+
+// Encode Serialize image to the current container version
+func (img *Image) Encode() []byte {
+	b := new(bytes.Buffer)
+	b.WriteString(ImageMagic)
+	writeUint32(b, ImageVersion)
+	writeUint32(b, img.Entry)
+	writeUint32(b, img.MemSize)
+	writeUint32(b, img.OpStackSize)
+	writeUint32(b, img.CallStackSize)
+	writeUint32(b, len(img.Lang))
+	b.WriteString(img.Lang)
+
+	sections := [][]byte{nil, encodeWords(img.Code), img.SourceMap.encode(), encodeSymbols(img.Symbols), encodeRelocs(img.Instrs, img.Relocs)}
+	count := 0
+	for _, s := range sections {
+		if s != nil {
+			count++
+		}
+	}
+	writeUint32(b, count)
+	for id, s := range sections {
+		if s != nil {
+			writeUint32(b, id)
+			writeUint32(b, len(s))
+			b.Write(s)
+		}
+	}
+	writeUint32(b, int(crc32.ChecksumIEEE(b.Bytes())))
+	return b.Bytes()
+}
+
+// DecodeImage Parse container or headerless array of words
+func DecodeImage(data []byte) (*Image, error) {
+	if !bytes.HasPrefix(data, []byte(ImageMagic)) {
+		code, err := decodeWords(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Image{Version: 0, Code: code}, nil
+	}
+
+	if len(data) < len(ImageMagic)+4 {
+		return nil, errors.New("truncated image")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, errors.New("image checksum mismatch")
+	}
+
+	r := &imageReader{data: body, pos: len(ImageMagic)}
+	img := &Image{}
+	img.Version = r.uint32()
+	if r.err == nil && (img.Version < 1 || img.Version > ImageVersion) {
+		return nil, fmt.Errorf("unsupported image version %d", img.Version)
+	}
+	img.Entry = r.uint32()
+	img.MemSize = r.uint32()
+	img.OpStackSize = r.uint32()
+	img.CallStackSize = r.uint32()
+	img.Lang = string(r.bytes(r.uint32()))
+	count := r.uint32()
+	for i := 0; i < count && r.err == nil; i++ {
+		id := r.uint32()
+		payload := r.bytes(r.uint32())
+		if r.err != nil {
+			break
+		}
+		var err error
+		switch id {
+		case SectionCode:
+			img.Code, err = decodeWords(payload)
+		case SectionDebug:
+			img.SourceMap, err = decodeSourceMap(payload)
+		case SectionSymbols:
+			img.Symbols, err = decodeSymbols(payload)
+		case SectionRelocs:
+			img.Instrs, img.Relocs, err = decodeRelocs(payload)
+		}
+		// Unknown sections are skipped for forward compatibility
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.pos != len(body) {
+		return nil, errors.New("trailing data in image")
+	}
+	if img.Entry < 0 || img.Entry > len(img.Code) {
+		return nil, errors.New("entry point is out of code")
+	}
+	return img, nil
+}
+
+func encodeWords(code []int) []byte {
+	b := make([]byte, len(code)*4)
+	for i, v := range code {
+		binary.LittleEndian.PutUint32(b[i*4:], uint32(int32(v)))
+	}
+	return b
+}
+
+func decodeWords(data []byte) ([]int, error) {
+	if len(data)%4 != 0 {
+		return nil, errors.New("invalid byte alignment")
+	}
+	code := make([]int, len(data)/4)
+	for i := range code {
+		code[i] = int(int32(binary.LittleEndian.Uint32(data[i*4:])))
+	}
+	return code, nil
+}
+
+func encodeSymbols(symbols map[int]string) []byte {
+	if len(symbols) == 0 {
+		return nil
+	}
+	addrs := make([]int, 0, len(symbols))
+	for a := range symbols {
+		addrs = append(addrs, a)
+	}
+	sort.Ints(addrs)
+	b := new(bytes.Buffer)
+	writeUint32(b, len(addrs))
+	for _, a := range addrs {
+		writeUint32(b, a)
+		writeUint32(b, len(symbols[a]))
+		b.WriteString(symbols[a])
+	}
+	return b.Bytes()
+}
+
+func decodeSymbols(data []byte) (map[int]string, error) {
+	r := &imageReader{data: data}
+	count := r.uint32()
+	symbols := make(map[int]string)
+	for i := 0; i < count && r.err == nil; i++ {
+		a := r.uint32()
+		symbols[a] = string(r.bytes(r.uint32()))
+	}
+	return symbols, r.err
+}
+
+func encodeRelocs(instrs []int, relocs []int) []byte {
+	if instrs == nil {
+		return nil
+	}
+	b := new(bytes.Buffer)
+	for _, list := range [][]int{instrs, relocs} {
+		writeUint32(b, len(list))
+		for _, a := range list {
+			writeUint32(b, a)
+		}
+	}
+	return b.Bytes()
+}
+
+func decodeRelocs(data []byte) ([]int, []int, error) {
+	r := &imageReader{data: data}
+	var lists [2][]int
+	for i := range lists {
+		count := r.uint32()
+		lists[i] = make([]int, 0)
+		for j := 0; j < count && r.err == nil; j++ {
+			lists[i] = append(lists[i], r.uint32())
+		}
+	}
+	return lists[0], lists[1], r.err
+}
+
+func writeUint32(b *bytes.Buffer, v int) {
+	var u [4]byte
+	binary.LittleEndian.PutUint32(u[:], uint32(v))
+	b.Write(u[:])
+}
+
+// imageReader Sequential reader of little-endian fields, first error is kept
+type imageReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *imageReader) uint32() int {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(b))
+}
+
+func (r *imageReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = errors.New("truncated image")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
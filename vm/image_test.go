@@ -0,0 +1,113 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestImage_Encode(t *testing.T) {
+	sm := &SourceMap{File: "test.false"}
+	sm.Add(0, 1, 1)
+	sm.Add(2, 1, 5)
+	img := &Image{
+		Version:       ImageVersion,
+		Lang:          "false",
+		Entry:         2,
+		MemSize:       4096,
+		OpStackSize:   128,
+		CallStackSize: 64,
+		Code:          []int{InstrGoto, 3, -1, InstrEnd},
+		SourceMap:     sm,
+		Symbols:       map[int]string{2: "a"},
+	}
+	got, err := DecodeImage(img.Encode())
+	if err != nil {
+		t.Fatalf("DecodeImage() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, img) {
+		t.Errorf("DecodeImage() got = %+v, want %+v", got, img)
+	}
+}
+
+func TestDecodeImage(t *testing.T) {
+	valid := (&Image{Version: ImageVersion, Code: []int{InstrEnd}}).Encode()
+	corrupted := append([]byte(nil), valid...)
+	corrupted[len(corrupted)-5]++
+	future := append([]byte(ImageMagic), 99, 0, 0, 0)
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []int
+		wantErr bool
+	}{
+		{
+			name: "check headerless code",
+			data: []byte{1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 30, 0, 0, 0},
+			want: []int{InstrPush, -1, InstrEnd},
+		},
+		{
+			name:    "check headerless misaligned code",
+			data:    []byte{1, 0, 0},
+			wantErr: true,
+		},
+		{
+			name: "check container",
+			data: valid,
+			want: []int{InstrEnd},
+		},
+		{
+			name:    "check checksum mismatch",
+			data:    corrupted,
+			wantErr: true,
+		},
+		{
+			name:    "check truncated container",
+			data:    valid[:len(valid)-8],
+			wantErr: true,
+		},
+		{
+			name:    "check unsupported version",
+			data:    future,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeImage(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DecodeImage() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got.Code, tt.want) {
+				t.Errorf("DecodeImage() code = %v, want %v", got.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestImage_Relocate(t *testing.T) {
+	sm := &SourceMap{}
+	sm.Add(0, 1, 1)
+	img := &Image{
+		Entry:     0,
+		Code:      []int{InstrPush, 5, InstrGoto, 4, InstrStore, 100, InstrEnd},
+		SourceMap: sm,
+		Symbols:   map[int]string{4: "loop"},
+		Instrs:    []int{0, 2, 4, 6},
+		Relocs:    []int{3},
+	}
+	img.Relocate(10)
+	want := []int{InstrPush, 5, InstrGoto, 14, InstrStore, 100, InstrEnd}
+	if !reflect.DeepEqual(img.Code, want) {
+		t.Errorf("Relocate() code = %v, want %v", img.Code, want)
+	}
+	if img.Entry != 10 || img.Symbols[14] != "loop" || img.Relocs[0] != 13 || img.Instrs[3] != 16 {
+		t.Errorf("Relocate() image = %+v", img)
+	}
+	if pos, ok := img.SourceMap.Lookup(10); !ok || pos.Line != 1 {
+		t.Errorf("Relocate() source map lookup = %v, %v", pos, ok)
+	}
+	if _, ok := img.SourceMap.Lookup(9); ok {
+		t.Errorf("Relocate() source map has code before base")
+	}
+}
@@ -1,7 +1,5 @@
 package vm
 
-import "errors"
-
 type IntStack struct {
 	Array  []int
 	Offset int
@@ -23,9 +21,30 @@ func (s *IntStack) Reset() {
 
 }
 
+// Len Return the number of items in the stack
+func (s *IntStack) Len() int {
+	return s.Offset + s.Size - s.p
+}
+
+// Top Return up to n topmost items, topmost first
+func (s *IntStack) Top(n int) []int {
+	if n > s.Len() {
+		n = s.Len()
+	}
+	if n < 0 {
+		n = 0
+	}
+	top := make([]int, n)
+	copy(top, s.Array[s.p:s.p+n])
+	return top
+}
+
 func (s *IntStack) Pick(v int) (int, error) {
+	if v < 0 {
+		return 0, ErrOutOfBounds
+	}
 	if s.p+v >= s.Offset+s.Size {
-		return 0, errors.New("stack out of range")
+		return 0, ErrStackUnderflow
 
 	}
 	return s.Array[s.p+v], nil
@@ -33,7 +52,7 @@ func (s *IntStack) Pick(v int) (int, error) {
 
 func (s *IntStack) Push(v int) error {
 	if s.p-1 < s.Offset {
-		return errors.New("stack overflow")
+		return ErrStackOverflow
 
 	}
 	s.p--
@@ -41,13 +60,16 @@ func (s *IntStack) Push(v int) error {
 	return nil
 }
 
-func (s *IntStack) Peek() int {
-	return s.Array[s.p]
+func (s *IntStack) Peek() (int, error) {
+	if s.p >= s.Offset+s.Size {
+		return 0, ErrStackUnderflow
+	}
+	return s.Array[s.p], nil
 }
 
 func (s *IntStack) Pop() (int, error) {
 	if s.p >= s.Offset+s.Size {
-		return 0, errors.New("stack underflow")
+		return 0, ErrStackUnderflow
 	}
 	i := s.Array[s.p]
 	s.p++
@@ -0,0 +1,110 @@
+package vm
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+
+	"golang.org/x/term"
+)
+
+// IO is the character device used by the VM input/output instructions
+type IO interface {
+	ReadChar() (int, error)
+	WriteChar(v int) error
+	WriteInt(v int) error
+	WriteStr(s string) error
+	Flush() error
+}
+
+// StreamIO Buffered IO over arbitrary reader and writer
+type StreamIO struct {
+	r *bufio.Reader
+	w *bufio.Writer
+	// CRLF Write '\r' before every '\n' (required by terminals in raw mode)
+	CRLF bool
+}
+
+func NewStreamIO(r io.Reader, w io.Writer) *StreamIO {
+	return &StreamIO{
+		r: bufio.NewReader(r),
+		w: bufio.NewWriter(w),
+	}
+}
+
+func (s *StreamIO) ReadChar() (int, error) {
+	c, _, err := s.r.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	return int(c), nil
+}
+
+func (s *StreamIO) WriteChar(v int) error {
+	if s.CRLF && v == '\n' {
+		if _, err := s.w.WriteRune('\r'); err != nil {
+			return err
+		}
+	}
+	_, err := s.w.WriteRune(rune(v))
+	return err
+}
+
+func (s *StreamIO) WriteInt(v int) error {
+	_, err := s.w.WriteString(strconv.Itoa(v))
+	return err
+}
+
+func (s *StreamIO) WriteStr(str string) error {
+	for _, c := range str {
+		if err := s.WriteChar(int(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *StreamIO) Flush() error {
+	return s.w.Flush()
+}
+
+// TermIO StreamIO bound to the terminal, switching it to raw mode while open
+type TermIO struct {
+	*StreamIO
+	in       *os.File
+	oldState *term.State
+}
+
+func NewTermIO(in *os.File, out *os.File) *TermIO {
+	s := NewStreamIO(in, out)
+	s.CRLF = true
+	return &TermIO{StreamIO: s, in: in}
+}
+
+// Open Switch terminal to raw mode
+func (t *TermIO) Open() error {
+	fd := int(t.in.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("input is not a terminal")
+	}
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	t.oldState = oldState
+	return nil
+}
+
+// Close Flush output and restore terminal state
+func (t *TermIO) Close() error {
+	err := t.Flush()
+	if t.oldState != nil {
+		if rErr := term.Restore(int(t.in.Fd()), t.oldState); rErr != nil && err == nil {
+			err = rErr
+		}
+		t.oldState = nil
+	}
+	return err
+}
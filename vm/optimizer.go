@@ -0,0 +1,460 @@
+package vm
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// Optimization levels
+const (
+	// OptNone Code is left as is
+	OptNone = 0
+	// OptPeephole Constant folding, Push/Drop elimination and redundant Fetch/Store removal
+	OptPeephole = 1
+	// OptFull Peephole plus jump threading and unreachable code removal
+	OptFull = 2
+)
+
+var ErrNoRelocations = errors.New("image has no relocation info")
+
+// optItem Instruction or single data word of the code being optimized
+type optItem struct {
+	Instruction
+	// addr, size Words of the original code covered by the item
+	addr int
+	size int
+	// relocs Args holding addresses
+	relocs []bool
+	// pinned Item is referenced inside (self-modifying code), it is never changed
+	pinned bool
+}
+
+func (it *optItem) reloc(i int) bool {
+	return it.relocs != nil && it.relocs[i]
+}
+
+// optimizer Decoded code with the set of addresses it refers to; instructions at referenced addresses
+// may start a pattern but never continue it, so branch targets are preserved
+type optimizer struct {
+	items   []*optItem
+	targets map[int]bool
+	entry   int
+	// size Length of the original code, addresses below it are always in memory
+	size int
+}
+
+// Optimize Return optimized copy of the image, its source map, symbols and relocations are remapped to the new code
+func Optimize(img *Image, level int) (*Image, error) {
+	if level <= OptNone {
+		return img, nil
+	}
+	if img.Instrs == nil {
+		return nil, ErrNoRelocations
+	}
+	o := newOptimizer(img)
+	for changed := true; changed; {
+		changed = o.peephole()
+		if level >= OptFull {
+			changed = o.threadJumps() || changed
+			changed = o.removeUnreachable() || changed
+		}
+	}
+	return o.image(img), nil
+}
+
+func newOptimizer(img *Image) *optimizer {
+	instrs := make(map[int]bool, len(img.Instrs))
+	for _, a := range img.Instrs {
+		instrs[a] = true
+	}
+	relocs := make(map[int]bool, len(img.Relocs))
+	o := &optimizer{targets: make(map[int]bool), entry: img.Entry, size: len(img.Code)}
+	for _, a := range img.Relocs {
+		relocs[a] = true
+		if a >= 0 && a < len(img.Code) {
+			o.targets[img.Code[a]] = true
+		}
+	}
+	o.targets[img.Entry] = true
+	for a := range img.Symbols {
+		o.targets[a] = true
+	}
+
+	for addr := 0; addr < len(img.Code); {
+		it := &optItem{addr: addr}
+		if instrs[addr] {
+			it.Instruction = decodeInstruction(img.Code, addr, len(img.Code))
+		}
+		if !instrs[addr] || it.Data {
+			it.Instruction = Instruction{Addr: addr, Args: []int{img.Code[addr]}, Data: true}
+		}
+		it.size = it.Len()
+		first := addr
+		if !it.Data {
+			first++
+		}
+		for i := range it.Args {
+			if relocs[first+i] {
+				if it.relocs == nil {
+					it.relocs = make([]bool, len(it.Args))
+				}
+				it.relocs[i] = true
+			}
+		}
+		for a := addr + 1; a < addr+it.size; a++ {
+			it.pinned = it.pinned || o.targets[a]
+		}
+		o.items = append(o.items, it)
+		addr += it.size
+	}
+	// Numbers pushed for calls and jumps are branch targets too (e.g. asm Push 4 Call), they are not relocated
+	for i := range o.items {
+		if a, ok := o.pushTarget(i); ok {
+			o.targets[a] = true
+		}
+	}
+	return o
+}
+
+// pushTarget Address pushed by the unrelocated Push at the item index if it is the start of an instruction
+// and Call, CallIf or GotoIf takes it from the stack (CallIf condition and GotoIf target follow by 2 items at most)
+func (o *optimizer) pushTarget(i int) (int, bool) {
+	it := o.items[i]
+	if it.Data || it.Op != InstrPush || it.reloc(0) {
+		return 0, false
+	}
+	branch := false
+	for _, next := range o.items[i+1 : min(i+3, len(o.items))] {
+		if next.Data {
+			break
+		}
+		if next.Op == InstrCall || next.Op == InstrCallIf || next.Op == InstrGotoIf {
+			branch = true
+			break
+		}
+	}
+	a := it.Args[0]
+	if j := o.find(a); branch && j < len(o.items) && o.items[j].addr == a && !o.items[j].Data {
+		return a, true
+	}
+	return 0, false
+}
+
+// plain Instruction which may be changed: not data, not pinned and not a branch target unless it starts the pattern
+func (o *optimizer) plain(i int, first bool) *optItem {
+	if i >= len(o.items) {
+		return nil
+	}
+	it := o.items[i]
+	if it.Data || it.pinned || (!first && o.targets[it.addr]) {
+		return nil
+	}
+	return it
+}
+
+// inCode Address is inside the original code, so memory access to it never faults
+func (o *optimizer) inCode(addr int) bool {
+	return addr >= 0 && addr < o.size
+}
+
+// merge Item replacing the original items from..to (inclusive)
+func (o *optimizer) merge(from int, to int, in Instruction, relocs []bool) *optItem {
+	size := 0
+	for _, it := range o.items[from : to+1] {
+		size += it.size
+	}
+	return &optItem{Instruction: in, addr: o.items[from].addr, size: size, relocs: relocs}
+}
+
+// peephole Apply local patterns, returns true if the code is changed
+func (o *optimizer) peephole() bool {
+	changed := false
+	res := make([]*optItem, 0, len(o.items))
+	for i := 0; i < len(o.items); {
+		if repl, n := o.match(i); n > 0 {
+			res = append(res, repl...)
+			i += n
+			changed = true
+			continue
+		}
+		res = append(res, o.items[i])
+		i++
+	}
+	o.items = res
+	return changed
+}
+
+// match Pattern starting at the item, returns replacement and number of the replaced items
+func (o *optimizer) match(i int) ([]*optItem, int) {
+	a := o.plain(i, true)
+	b := o.plain(i+1, false)
+	if a == nil || b == nil {
+		return nil, 0
+	}
+	switch {
+	case a.Op == InstrPush && b.Op == InstrDrop:
+		return nil, 2
+	case a.Op == InstrFetch && b.Op == InstrStore && a.Args[0] == b.Args[0] && a.reloc(0) && b.reloc(0) && o.inCode(a.Args[0]):
+		return nil, 2
+	case a.Op == InstrStore && b.Op == InstrFetch && a.Args[0] == b.Args[0] && a.reloc(0) && b.reloc(0):
+		dup := &optItem{Instruction: Instruction{Op: InstrDup}, addr: a.addr, size: a.size}
+		store := &optItem{Instruction: Instruction{Op: InstrStore, Args: a.Args}, addr: b.addr, size: b.size, relocs: a.relocs}
+		return []*optItem{dup, store}, 2
+	case a.Op == InstrPush && !a.reloc(0):
+		if v, ok := foldUnary(b.Op, a.Args[0]); ok {
+			return []*optItem{o.merge(i, i+1, Instruction{Op: InstrPush, Args: []int{v}}, nil)}, 2
+		}
+	}
+	c := o.plain(i+2, false)
+	if c == nil || a.Op != InstrPush || b.Op != InstrPush {
+		return nil, 0
+	}
+	if c.Op == InstrSwap {
+		first := &optItem{Instruction: b.Instruction, addr: a.addr, size: a.size, relocs: b.relocs}
+		second := &optItem{Instruction: a.Instruction, addr: b.addr, size: b.size + c.size, relocs: a.relocs}
+		return []*optItem{first, second}, 3
+	}
+	if a.reloc(0) || b.reloc(0) {
+		return nil, 0
+	}
+	if v, ok := foldBinary(c.Op, a.Args[0], b.Args[0]); ok {
+		return []*optItem{o.merge(i, i+2, Instruction{Op: InstrPush, Args: []int{v}}, nil)}, 3
+	}
+	return nil, 0
+}
+
+// foldUnary Result of the unary instruction on constant, folded only if it is the same in every arithmetic mode
+func foldUnary(op int, v int) (int, bool) {
+	switch op {
+	case InstrNegative:
+		return fit32(-int64(v))
+	case InstrNot:
+		if v == 0 {
+			return 1, true
+		}
+		return 0, true
+	case InstrBitNot:
+		return ^v, true
+	}
+	return 0, false
+}
+
+// foldBinary Result of the binary instruction on constants, folded only if it is the same in every arithmetic mode
+func foldBinary(op int, a int, b int) (int, bool) {
+	switch op {
+	case InstrPlus:
+		return fit32(int64(a) + int64(b))
+	case InstrMinus:
+		return fit32(int64(a) - int64(b))
+	case InstrMultiply:
+		return fit32(int64(a) * int64(b))
+	case InstrDivide:
+		if b == 0 {
+			return 0, false
+		}
+		return fit32(int64(a) / int64(b))
+	case InstrMod:
+		if b == 0 {
+			return 0, false
+		}
+		r := a % b
+		if r != 0 && (r < 0) != (b < 0) {
+			r += b
+		}
+		return r, true
+	case InstrAnd:
+		return boolInt(a != 0 && b != 0), true
+	case InstrOr:
+		return boolInt(a != 0 || b != 0), true
+	case InstrBitAnd:
+		return a & b, true
+	case InstrBitOr:
+		return a | b, true
+	case InstrMore:
+		return boolInt(a > b), true
+	case InstrEquals:
+		return boolInt(a == b), true
+	}
+	return 0, false
+}
+
+func fit32(v int64) (int, bool) {
+	return int(v), v >= math.MinInt32 && v <= math.MaxInt32
+}
+
+func boolInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// find Index of the first item at or after the original address, removed code falls through to it
+func (o *optimizer) find(addr int) int {
+	return sort.Search(len(o.items), func(i int) bool { return o.items[i].addr >= addr })
+}
+
+// threadJumps Redirect Goto to Goto to the final target and remove Goto to the next instruction
+func (o *optimizer) threadJumps() bool {
+	changed := false
+	res := make([]*optItem, 0, len(o.items))
+	for i, it := range o.items {
+		if it.Data || it.pinned || it.Op != InstrGoto || !it.reloc(0) {
+			res = append(res, it)
+			continue
+		}
+		t := it.Args[0]
+		for n := 0; n < len(o.items); n++ {
+			j := o.find(t)
+			if j >= len(o.items) {
+				break
+			}
+			next := o.items[j]
+			if next.Data || next.pinned || next.Op != InstrGoto || !next.reloc(0) || next.Args[0] == t {
+				break
+			}
+			t = next.Args[0]
+		}
+		if t != it.Args[0] {
+			it = &optItem{Instruction: Instruction{Op: InstrGoto, Args: []int{t}}, addr: it.addr, size: it.size, relocs: it.relocs}
+			changed = true
+		}
+		if o.find(t) == i+1 {
+			changed = true
+			continue
+		}
+		res = append(res, it)
+	}
+	o.items = res
+	return changed
+}
+
+// removeUnreachable Remove instructions not reachable from the entry point or any address in the code. Unrelocated
+// Push values which land on instruction starts are roots too, since they may be numeric code addresses (asm
+// Push 10 followed by Call, FALSE inline bytecode)
+func (o *optimizer) removeUnreachable() bool {
+	reached := make([]bool, len(o.items))
+	var queue []int
+	visit := func(addr int) {
+		if i := o.find(addr); i < len(o.items) && !reached[i] {
+			reached[i] = true
+			queue = append(queue, i)
+		}
+	}
+	visit(o.entry)
+	for i, it := range o.items {
+		for k, v := range it.Args {
+			if it.reloc(k) {
+				visit(v)
+			}
+		}
+		if a, ok := o.pushTarget(i); ok {
+			visit(a)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		it := o.items[i]
+		if it.Data {
+			continue
+		}
+		switch it.Op {
+		case InstrGoto:
+			visit(it.Args[0])
+		case InstrEnd, InstrReturn:
+		default:
+			if i+1 < len(o.items) {
+				visit(o.items[i+1].addr)
+			}
+		}
+	}
+
+	changed := false
+	res := make([]*optItem, 0, len(o.items))
+	for i, it := range o.items {
+		if !reached[i] && !it.Data && !it.pinned {
+			changed = true
+			continue
+		}
+		res = append(res, it)
+	}
+	o.items = res
+	return changed
+}
+
+// image Lay out the items and remap addresses of the original code to the new one
+func (o *optimizer) image(img *Image) *Image {
+	oldLen := len(img.Code)
+	remap := make([]int, oldLen+1)
+	mapped := make([]bool, oldLen+1)
+	res := &Image{
+		Version:       img.Version,
+		Lang:          img.Lang,
+		MemSize:       img.MemSize,
+		OpStackSize:   img.OpStackSize,
+		CallStackSize: img.CallStackSize,
+		Instrs:        make([]int, 0),
+		Relocs:        make([]int, 0),
+	}
+	for _, it := range o.items {
+		n := len(res.Code)
+		for k := 0; k < it.size; k++ {
+			remap[it.addr+k] = n + min(k, it.Len()-1)
+			mapped[it.addr+k] = true
+		}
+		if !it.Data {
+			res.Instrs = append(res.Instrs, n)
+			res.Code = append(res.Code, it.Op)
+		}
+		for k, v := range it.Args {
+			if it.reloc(k) {
+				res.Relocs = append(res.Relocs, len(res.Code))
+			}
+			res.Code = append(res.Code, v)
+		}
+	}
+	// Removed code is mapped to the next item
+	remap[oldLen] = len(res.Code)
+	for a := oldLen - 1; a >= 0; a-- {
+		if !mapped[a] {
+			remap[a] = remap[a+1]
+		}
+	}
+	addr := func(v int) int {
+		switch {
+		case v < 0:
+			return v
+		case v > oldLen:
+			return v - oldLen + len(res.Code)
+		}
+		return remap[v]
+	}
+
+	for _, r := range res.Relocs {
+		res.Code[r] = addr(res.Code[r])
+	}
+	res.Entry = addr(img.Entry)
+	if img.Symbols != nil {
+		res.Symbols = make(map[int]string)
+		addrs := make([]int, 0, len(img.Symbols))
+		for a := range img.Symbols {
+			addrs = append(addrs, a)
+		}
+		// Symbol of the removed code is kept only if the next item has no own one
+		sort.Sort(sort.Reverse(sort.IntSlice(addrs)))
+		for _, a := range addrs {
+			if _, ok := res.Symbols[addr(a)]; !ok {
+				res.Symbols[addr(a)] = img.Symbols[a]
+			}
+		}
+	}
+	if img.SourceMap != nil {
+		res.SourceMap = &SourceMap{File: img.SourceMap.File}
+		for _, e := range img.SourceMap.entries {
+			res.SourceMap.Add(addr(e.addr), e.pos.Line, e.pos.Col)
+		}
+	}
+	return res
+}
@@ -0,0 +1,230 @@
+package vm
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name  string
+		level int
+		write func(bc *BytecodeWriter)
+		want  []int
+	}{
+		{
+			name:  "check constant folding",
+			level: OptPeephole,
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(2)
+				bc.WritePush(3)
+				bc.WriteCommand(InstrPlus)
+				bc.WritePush(4)
+				bc.WriteCommand(InstrMultiply)
+				bc.WriteCommand(InstrNegative)
+				bc.WriteCommand(InstrWriteInt)
+			},
+			want: []int{InstrPush, -20, InstrWriteInt, InstrEnd},
+		},
+		{
+			name:  "check overflow is not folded",
+			level: OptPeephole,
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(math.MaxInt32)
+				bc.WritePush(1)
+				bc.WriteCommand(InstrPlus)
+			},
+			want: []int{InstrPush, math.MaxInt32, InstrPush, 1, InstrPlus, InstrEnd},
+		},
+		{
+			name:  "check division by zero is not folded",
+			level: OptPeephole,
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(1)
+				bc.WritePush(0)
+				bc.WriteCommand(InstrDivide)
+			},
+			want: []int{InstrPush, 1, InstrPush, 0, InstrDivide, InstrEnd},
+		},
+		{
+			name:  "check push drop and swap",
+			level: OptPeephole,
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(1)
+				bc.WriteCommand(InstrDrop)
+				bc.WritePush(1)
+				bc.WritePush(2)
+				bc.WriteCommand(InstrSwap)
+			},
+			want: []int{InstrPush, 2, InstrPush, 1, InstrEnd},
+		},
+		{
+			name:  "check redundant fetch and store",
+			level: OptPeephole,
+			write: func(bc *BytecodeWriter) {
+				v := bc.WriteVar(0)
+				bc.WriteCommand(InstrReadChar)
+				bc.WriteStore(v)
+				bc.WriteFetch(v)
+				bc.WriteFetch(v)
+				bc.WriteStore(v)
+			},
+			want: []int{InstrGoto, 3, 0, InstrReadChar, InstrDup, InstrStore, 2, InstrEnd},
+		},
+		{
+			name:  "check branch target is preserved",
+			level: OptPeephole,
+			write: func(bc *BytecodeWriter) {
+				l := bc.NewLabel()
+				bc.WritePush(1)
+				bc.Bind(l)
+				bc.WriteCommand(InstrDrop)
+				bc.WritePushLabel(l)
+				bc.WriteCall()
+			},
+			want: []int{InstrPush, 1, InstrDrop, InstrPush, 2, InstrCall, InstrEnd},
+		},
+		{
+			name:  "check numeric branch target is preserved",
+			level: OptPeephole,
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(1)
+				bc.WriteCommand(InstrDrop)
+				bc.WritePush(2)
+				bc.WriteCall()
+			},
+			want: []int{InstrPush, 1, InstrDrop, InstrPush, 2, InstrCall, InstrEnd},
+		},
+		{
+			name:  "check fetch and store out of code are kept",
+			level: OptPeephole,
+			write: func(bc *BytecodeWriter) {
+				bc.WriteFetch(100000)
+				bc.WriteStore(100000)
+			},
+			want: []int{InstrFetch, 100000, InstrStore, 100000, InstrEnd},
+		},
+		{
+			name:  "check jumps are kept by peephole level",
+			level: OptPeephole,
+			write: func(bc *BytecodeWriter) {
+				l := bc.NewLabel()
+				bc.WriteGotoLabel(l)
+				bc.Bind(l)
+			},
+			want: []int{InstrGoto, 2, InstrEnd},
+		},
+		{
+			name:  "check jump threading removes goto chain",
+			level: OptFull,
+			write: func(bc *BytecodeWriter) {
+				l1, l2, l3 := bc.NewLabel(), bc.NewLabel(), bc.NewLabel()
+				bc.WriteGotoLabel(l1)
+				bc.Bind(l2)
+				bc.WriteGotoLabel(l3)
+				bc.Bind(l1)
+				bc.WriteGotoLabel(l2)
+				bc.WriteCommand(InstrDup)
+				bc.Bind(l3)
+				bc.WriteCommand(InstrWriteInt)
+			},
+			want: []int{InstrWriteInt, InstrEnd},
+		},
+		{
+			name:  "check jump threading",
+			level: OptFull,
+			write: func(bc *BytecodeWriter) {
+				l1, l2 := bc.NewLabel(), bc.NewLabel()
+				bc.WriteCommand(InstrReadChar)
+				bc.WritePushLabel(l1)
+				bc.WriteGotoIf()
+				bc.WriteCommand(InstrDup)
+				bc.Bind(l1)
+				bc.WriteGotoLabel(l2)
+				bc.WriteCommand(InstrDup)
+				bc.Bind(l2)
+				bc.WriteCommand(InstrWriteInt)
+			},
+			want: []int{InstrReadChar, InstrPush, 5, InstrGotoIf, InstrDup, InstrWriteInt, InstrEnd},
+		},
+		{
+			name:  "check unreachable code removal",
+			level: OptFull,
+			write: func(bc *BytecodeWriter) {
+				bc.WriteCommand(InstrWriteInt)
+				bc.WriteEnd()
+				bc.WriteCommand(InstrDup)
+				bc.WriteCommand(InstrDrop)
+			},
+			want: []int{InstrWriteInt, InstrEnd},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := NewBytecodeWriter()
+			tt.write(bc)
+			bc.WriteEnd()
+			img, err := bc.Image()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Optimize(img, tt.level)
+			if err != nil {
+				t.Fatalf("Optimize() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Code, tt.want) {
+				t.Errorf("Optimize() got = %v, want %v", got.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptimize_Remap(t *testing.T) {
+	bc := NewBytecodeWriter()
+	bc.SetSourcePos(1, 1)
+	bc.WritePush(1)
+	bc.WriteCommand(InstrDrop)
+	bc.SetSourcePos(2, 1)
+	sub := bc.NewLabel()
+	bc.WritePushLabel(sub)
+	bc.WriteCall()
+	bc.WriteEnd()
+	bc.Bind(sub)
+	bc.AddSymbol(bc.Len(), "sub")
+	bc.SetSourcePos(3, 1)
+	bc.WriteCommand(InstrReturn)
+	img, err := bc.Image()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Optimize(img, OptPeephole)
+	if err != nil {
+		t.Fatalf("Optimize() error = %v", err)
+	}
+	want := []int{InstrPush, 4, InstrCall, InstrEnd, InstrReturn}
+	if !reflect.DeepEqual(got.Code, want) {
+		t.Errorf("Optimize() got = %v, want %v", got.Code, want)
+	}
+	if got.Symbols[4] != "sub" {
+		t.Errorf("Optimize() symbols = %v, want sub at 4", got.Symbols)
+	}
+	if s := got.SourceMap.Format(4); s != ":3:1" {
+		t.Errorf("Optimize() source of 4 = %q, want %q", s, ":3:1")
+	}
+	if s := got.SourceMap.Format(0); s != ":2:1" {
+		t.Errorf("Optimize() source of 0 = %q, want %q", s, ":2:1")
+	}
+	if !reflect.DeepEqual(got.Relocs, []int{1}) {
+		t.Errorf("Optimize() relocs = %v, want [1]", got.Relocs)
+	}
+}
+
+func TestOptimize_NoRelocations(t *testing.T) {
+	_, err := Optimize(&Image{Code: []int{InstrEnd}}, OptPeephole)
+	if !errors.Is(err, ErrNoRelocations) {
+		t.Errorf("Optimize() error = %v, want %v", err, ErrNoRelocations)
+	}
+}
@@ -0,0 +1,216 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+)
+
+// protoBuffer Minimal protocol buffers encoder for the pprof profile.proto messages
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	b.WriteByte(byte(v))
+}
+
+// key Field number with its wire type: 0 for varint, 2 for length delimited
+func (b *protoBuffer) key(field int, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+// int Varint field, zero values are omitted as in proto3
+func (b *protoBuffer) int(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	b.key(field, 0)
+	b.varint(uint64(v))
+}
+
+func (b *protoBuffer) bool(field int, v bool) {
+	b.int(field, int64(boolInt(v)))
+}
+
+// bytes Length delimited field
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuffer) packed(field int, vs []uint64) {
+	var p protoBuffer
+	for _, v := range vs {
+		p.varint(v)
+	}
+	b.bytes(field, p.Bytes())
+}
+
+// msg Embedded message written by the function
+func (b *protoBuffer) msg(field int, write func(m *protoBuffer)) {
+	var m protoBuffer
+	write(&m)
+	b.bytes(field, m.Bytes())
+}
+
+// pprof Profile being built: string table, functions of lambdas and locations of (address, lambda) pairs
+type pprof struct {
+	strings   map[string]int64
+	table     []string
+	functions map[int]uint64
+	// funcOrder Lambdas in order of function ids
+	funcOrder []int
+	locations map[[2]int]uint64
+	locOrder  [][2]int
+	samples   []pprofSample
+}
+
+type pprofSample struct {
+	stack []uint64
+	count int64
+}
+
+func (pp *pprof) str(s string) int64 {
+	if i, ok := pp.strings[s]; ok {
+		return i
+	}
+	i := int64(len(pp.table))
+	pp.strings[s] = i
+	pp.table = append(pp.table, s)
+	return i
+}
+
+func (pp *pprof) function(sub int) uint64 {
+	if id, ok := pp.functions[sub]; ok {
+		return id
+	}
+	id := uint64(len(pp.funcOrder) + 1)
+	pp.functions[sub] = id
+	pp.funcOrder = append(pp.funcOrder, sub)
+	return id
+}
+
+// location Location of the address executed by the lambda
+func (pp *pprof) location(addr int, sub int) uint64 {
+	key := [2]int{addr, sub}
+	if id, ok := pp.locations[key]; ok {
+		return id
+	}
+	pp.function(sub)
+	id := uint64(len(pp.locOrder) + 1)
+	pp.locations[key] = id
+	pp.locOrder = append(pp.locOrder, key)
+	return id
+}
+
+// walk Add samples of the node, stacks are the executed address followed by the call sites up to the main program
+func (pp *pprof) walk(n *profNode, callers []uint64) {
+	addrs := make([]int, 0, len(n.counts))
+	for a := range n.counts {
+		addrs = append(addrs, a)
+	}
+	sort.Ints(addrs)
+	for _, a := range addrs {
+		stack := append([]uint64{pp.location(a, n.sub)}, callers...)
+		pp.samples = append(pp.samples, pprofSample{stack: stack, count: n.counts[a]})
+	}
+	keys := make([][2]int, 0, len(n.children))
+	for k := range n.children {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		c := n.children[k]
+		pp.walk(c, append([]uint64{pp.location(c.site, n.sub)}, callers...))
+	}
+}
+
+// WritePprof Write gzipped profile in the pprof format (profile.proto) for go tool pprof: samples count executed
+// instructions, functions are lambdas and lines are source positions from the image source map
+func (p *Profiler) WritePprof(w io.Writer, img *Image) error {
+	pp := &pprof{
+		strings:   make(map[string]int64),
+		functions: make(map[int]uint64),
+		locations: make(map[[2]int]uint64),
+	}
+	// String table starts with the empty string
+	pp.str("")
+	pp.walk(p.root, nil)
+
+	file := ""
+	if img.SourceMap != nil {
+		file = img.SourceMap.File
+	}
+	var b protoBuffer
+	valueType := func(field int, typ, unit string) {
+		b.msg(field, func(m *protoBuffer) {
+			m.int(1, pp.str(typ))
+			m.int(2, pp.str(unit))
+		})
+	}
+	valueType(1, "instructions", "count")
+	for _, s := range pp.samples {
+		b.msg(2, func(m *protoBuffer) {
+			m.packed(1, s.stack)
+			m.packed(2, []uint64{uint64(s.count)})
+		})
+	}
+	b.msg(3, func(m *protoBuffer) {
+		m.int(1, 1)
+		m.int(3, int64(len(img.Code)))
+		m.int(5, pp.str(file))
+		m.bool(7, true)
+		m.bool(8, file != "")
+		m.bool(9, img.SourceMap.Len() > 0)
+	})
+	for i, key := range pp.locOrder {
+		b.msg(4, func(m *protoBuffer) {
+			m.int(1, int64(i+1))
+			m.int(2, 1)
+			m.int(3, int64(key[0]))
+			m.msg(4, func(l *protoBuffer) {
+				l.int(1, int64(pp.functions[key[1]]))
+				if pos, ok := img.SourceMap.Lookup(key[0]); ok {
+					l.int(2, int64(pos.Line))
+					l.int(3, int64(pos.Col))
+				}
+			})
+		})
+	}
+	for i, sub := range pp.funcOrder {
+		name := lambdaName(img, sub)
+		b.msg(5, func(m *protoBuffer) {
+			m.int(1, int64(i+1))
+			m.int(2, pp.str(name))
+			m.int(3, pp.str(name))
+			m.int(4, pp.str(file))
+			if pos, ok := img.SourceMap.Lookup(sub); ok {
+				m.int(5, int64(pos.Line))
+			}
+		})
+	}
+	valueType(11, "instructions", "count")
+	b.int(12, 1)
+	// String table is written last since the messages above add to it
+	for _, s := range pp.table {
+		b.bytes(6, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,203 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Profiler Counts executed instructions per address and opcode and attributes them to the lambdas (subs) on the call
+// stack, set it to VM.Profile
+type Profiler struct {
+	// Addrs, Ops Executions per address and per instruction code
+	Addrs map[int]int64
+	Ops   map[int]int64
+	// Total Number of executed instructions
+	Total int64
+
+	root *profNode
+	// stack Shadow call stack: nodes of the active calls with the call stack depth inside them
+	stack   []profFrame
+	started bool
+}
+
+// profNode Call tree node: the sub entered from the call site of the parent node, counts are executions per address.
+// Recursive calls reuse the node of the sub already on the path from the root, so the tree size is bounded by the
+// number of distinct call paths without recursion
+type profNode struct {
+	sub      int
+	site     int
+	parent   *profNode
+	children map[[2]int]*profNode
+	counts   map[int]int64
+}
+
+type profFrame struct {
+	node  *profNode
+	depth int
+}
+
+// profMain Sub address of the main program in the call tree
+const profMain = -1
+
+func NewProfiler() *Profiler {
+	root := &profNode{sub: profMain, site: -1, counts: make(map[int]int64)}
+	return &Profiler{Addrs: make(map[int]int64), Ops: make(map[int]int64), root: root, stack: []profFrame{{node: root}}}
+}
+
+// record Count the instruction executed at the address with the call stack depth before it and follow the call
+// stack change made by it
+func (p *Profiler) record(vm *VM, ip int, op int, depth int) {
+	top := len(p.stack) - 1
+	p.Addrs[ip]++
+	p.Ops[op]++
+	p.Total++
+	p.stack[top].node.counts[ip]++
+
+	if !p.started {
+		// Program may start with non-empty call stack, e.g. in REPL
+		p.started = true
+		p.stack[0].depth = depth
+	}
+	switch after := vm.CallStack.Len(); {
+	case after > depth:
+		p.stack = append(p.stack, profFrame{node: p.stack[top].node.enter(ip, vm.ip), depth: after})
+	case after < depth:
+		for len(p.stack) > 1 && after < p.stack[len(p.stack)-1].depth {
+			p.stack = p.stack[:len(p.stack)-1]
+		}
+	}
+}
+
+// enter Node of the sub called from the site, it is the ancestor node for recursive calls
+func (n *profNode) enter(site int, sub int) *profNode {
+	for a := n; a != nil; a = a.parent {
+		if a.sub == sub {
+			return a
+		}
+	}
+	key := [2]int{site, sub}
+	c, ok := n.children[key]
+	if !ok {
+		c = &profNode{sub: sub, site: site, parent: n, counts: make(map[int]int64)}
+		if n.children == nil {
+			n.children = make(map[[2]int]*profNode)
+		}
+		n.children[key] = c
+	}
+	return c
+}
+
+// ProfileEntry Hot spot of the report
+type ProfileEntry struct {
+	// Addr Instruction address, opcode or lambda start address (-1 for the main program)
+	Addr int
+	Name string
+	// Self Instructions executed at the address or in the lambda body, Total includes the lambdas called by it
+	Self  int64
+	Total int64
+}
+
+// Lambdas Instructions executed by every lambda, recursive calls are counted once in total
+func (p *Profiler) Lambdas() []ProfileEntry {
+	self := make(map[int]int64)
+	total := make(map[int]int64)
+	// Recursion is collapsed in the tree, so the sub is met once on every path and its totals are not counted twice
+	var walk func(n *profNode) int64
+	walk = func(n *profNode) int64 {
+		var sum int64
+		for _, c := range n.counts {
+			sum += c
+		}
+		self[n.sub] += sum
+		for _, c := range n.children {
+			sum += walk(c)
+		}
+		total[n.sub] += sum
+		return sum
+	}
+	walk(p.root)
+	list := make([]ProfileEntry, 0, len(self))
+	for sub, s := range self {
+		list = append(list, ProfileEntry{Addr: sub, Self: s, Total: total[sub]})
+	}
+	sortEntries(list)
+	return list
+}
+
+func sortEntries(list []ProfileEntry) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Self != list[j].Self {
+			return list[i].Self > list[j].Self
+		}
+		return list[i].Addr < list[j].Addr
+	})
+}
+
+func countEntries(counts map[int]int64) []ProfileEntry {
+	list := make([]ProfileEntry, 0, len(counts))
+	for a, c := range counts {
+		list = append(list, ProfileEntry{Addr: a, Self: c, Total: c})
+	}
+	sortEntries(list)
+	return list
+}
+
+// lambdaName Symbol of the lambda start or lambda@addr, main for the main program
+func lambdaName(img *Image, sub int) string {
+	if sub == profMain {
+		return "main"
+	}
+	if name, ok := img.Symbols[sub]; ok {
+		return name
+	}
+	return fmt.Sprintf("lambda@%04d", sub)
+}
+
+// sourcePos Source position of the address as line:col, empty if it is unknown
+func sourcePos(img *Image, addr int) string {
+	pos, ok := img.SourceMap.Lookup(addr)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Col)
+}
+
+// WriteReport Write hot spots: top addresses, opcodes and lambdas (all of them if top is zero), the image supplies
+// instructions, symbols and source positions
+func (p *Profiler) WriteReport(w io.Writer, img *Image, top int) error {
+	percent := func(v int64) float64 {
+		if p.Total == 0 {
+			return 0
+		}
+		return float64(v) * 100 / float64(p.Total)
+	}
+	limit := func(list []ProfileEntry) []ProfileEntry {
+		if top > 0 && len(list) > top {
+			return list[:top]
+		}
+		return list
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d instructions executed\n\nhot addresses:\n", p.Total)
+	fmt.Fprintf(&b, "%12s %7s  %-5s %-24s %s\n", "count", "%", "addr", "instruction", "source")
+	for _, e := range limit(countEntries(p.Addrs)) {
+		in := ""
+		if e.Addr >= 0 && e.Addr < len(img.Code) {
+			in = DecodeInstruction(img.Code, e.Addr).String()
+		}
+		fmt.Fprintf(&b, "%12d %6.2f%%  %04d  %-24s %s\n", e.Self, percent(e.Self), e.Addr, in, sourcePos(img, e.Addr))
+	}
+	fmt.Fprintf(&b, "\nopcodes:\n%12s %7s  %s\n", "count", "%", "instruction")
+	for _, e := range limit(countEntries(p.Ops)) {
+		fmt.Fprintf(&b, "%12d %6.2f%%  %s\n", e.Self, percent(e.Self), InstrName(e.Addr))
+	}
+	fmt.Fprintf(&b, "\nlambdas:\n%12s %7s %12s %7s  %-16s %s\n", "self", "%", "total", "%", "lambda", "source")
+	for _, e := range limit(p.Lambdas()) {
+		fmt.Fprintf(&b, "%12d %6.2f%% %12d %6.2f%%  %-16s %s\n", e.Self, percent(e.Self), e.Total, percent(e.Total),
+			lambdaName(img, e.Addr), sourcePos(img, e.Addr))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
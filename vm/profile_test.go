@@ -0,0 +1,196 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// profileRun Run the program calling the sub twice, sub is named inc and placed at line 2
+func profileRun(t *testing.T) (*Profiler, *Image) {
+	bc := NewBytecodeWriter()
+	bc.SetSourcePos(1, 1)
+	bc.SubCreate()
+	bc.SetSourcePos(2, 1)
+	bc.AddSymbol(bc.Len(), "inc")
+	bc.WritePush(1)
+	bc.WriteCommand(InstrDrop)
+	if err := bc.SubReturn(); err != nil {
+		t.Fatal(err)
+	}
+	bc.SetSourcePos(3, 1)
+	bc.WriteCommand(InstrDup)
+	bc.WriteCall()
+	bc.WriteCall()
+	bc.WriteEnd()
+	img, err := bc.Image()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.SourceMap.File = "inc.false"
+	vm := NewVM(256, 32, 32)
+	vm.IO = NewStreamIO(strings.NewReader(""), new(bytes.Buffer))
+	if err = vm.LoadImage(img); err != nil {
+		t.Fatal(err)
+	}
+	vm.Profile = NewProfiler()
+	if err = vm.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	return vm.Profile, img
+}
+
+func TestProfiler_Counts(t *testing.T) {
+	p, _ := profileRun(t)
+	if p.Total != 12 {
+		t.Errorf("Total = %d, want 12", p.Total)
+	}
+	if got := p.Addrs[2]; got != 2 {
+		t.Errorf("Addrs[2] = %d, want 2", got)
+	}
+	if got := p.Ops[InstrCall]; got != 2 {
+		t.Errorf("Ops[Call] = %d, want 2", got)
+	}
+	want := []ProfileEntry{{Addr: profMain, Self: 6, Total: 12}, {Addr: 2, Self: 6, Total: 6}}
+	if got := p.Lambdas(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Lambdas() = %v, want %v", got, want)
+	}
+}
+
+func TestProfiler_WriteReport(t *testing.T) {
+	p, img := profileRun(t)
+	w := new(bytes.Buffer)
+	if err := p.WriteReport(w, img, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"12 instructions executed\n",
+		"           2  16.67%  0002  Push 1                   2:1\n",
+		"           3  25.00%  Push\n",
+		"           6  50.00%            6  50.00%  inc              2:1\n",
+	} {
+		if !strings.Contains(w.String(), want) {
+			t.Errorf("report = %q, want line %q", w.String(), want)
+		}
+	}
+	// Top limits every table
+	if strings.Contains(w.String(), "0005  Return") {
+		t.Errorf("report = %q, want 2 top addresses", w.String())
+	}
+}
+
+func TestProfiler_WritePprof(t *testing.T) {
+	p, img := profileRun(t)
+	w := new(bytes.Buffer)
+	if err := p.WritePprof(w, img); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Count top level fields of the profile message and collect the string table
+	fields := make(map[uint64]int)
+	var table []string
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(data)
+			data = data[n:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if key>>3 == 6 {
+				table = append(table, string(data[n:n+int(size)]))
+			}
+			data = data[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type of key %d", key)
+		}
+		fields[key>>3]++
+	}
+	// Samples: 6 main addresses and 3 inc addresses called from 2 call sites, call sites are main locations
+	want := map[uint64]int{1: 1, 2: 12, 3: 1, 4: 9, 5: 2, 6: len(table), 11: 1, 12: 1}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+	for _, s := range []string{"", "instructions", "count", "inc.false", "main", "inc"} {
+		found := false
+		for _, ts := range table {
+			found = found || ts == s
+		}
+		if !found {
+			t.Errorf("string table = %q, want %q", table, s)
+		}
+	}
+	if table[0] != "" {
+		t.Errorf("string table[0] = %q, want empty", table[0])
+	}
+}
+
+// profNodes Number of nodes in the call tree
+func profNodes(n *profNode) int {
+	count := 1
+	for _, c := range n.children {
+		count += profNodes(c)
+	}
+	return count
+}
+
+func TestProfiler_Recursion(t *testing.T) {
+	// Sub counts down the number on the stack calling itself, so the call stack gets 1000 deep
+	bc := NewBytecodeWriter()
+	sub, ret := bc.NewLabel(), bc.NewLabel()
+	bc.WritePush(1000)
+	bc.WritePushLabel(sub)
+	bc.WriteCall()
+	bc.WriteCommand(InstrDrop)
+	bc.WriteEnd()
+	bc.Bind(sub)
+	bc.WriteCommand(InstrDup)
+	bc.WriteCommand(InstrNot)
+	bc.WritePushLabel(ret)
+	bc.WriteGotoIf()
+	bc.WritePush(1)
+	bc.WriteCommand(InstrMinus)
+	bc.WritePushLabel(sub)
+	bc.WriteCall()
+	bc.Bind(ret)
+	bc.WriteCommand(InstrReturn)
+	img, err := bc.Image()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM(8192, 64, 2048)
+	vm.IO = NewStreamIO(strings.NewReader(""), new(bytes.Buffer))
+	if err = vm.LoadImage(img); err != nil {
+		t.Fatal(err)
+	}
+	vm.Profile = NewProfiler()
+	if err = vm.Run(); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	p := vm.Profile
+	// Recursive calls reuse the sub node: main and the sub only
+	if n := profNodes(p.root); n != 2 {
+		t.Errorf("call tree nodes = %d, want 2", n)
+	}
+	addr, _ := bc.LabelAddr(sub)
+	lambdas := p.Lambdas()
+	want := []ProfileEntry{{Addr: addr, Self: p.Total - 5, Total: p.Total - 5}, {Addr: profMain, Self: 5, Total: p.Total}}
+	if !reflect.DeepEqual(lambdas, want) {
+		t.Errorf("Lambdas() = %v, want %v", lambdas, want)
+	}
+	if len(p.stack) != 1 {
+		t.Errorf("shadow stack depth after run = %d, want 1", len(p.stack))
+	}
+}
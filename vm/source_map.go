@@ -0,0 +1,102 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+type SourcePos struct {
+	Line int
+	Col  int
+}
+
+type sourceEntry struct {
+	addr int
+	pos  SourcePos
+}
+
+// SourceMap Maps bytecode addresses to the source positions they are compiled from
+type SourceMap struct {
+	File    string
+	entries []sourceEntry
+}
+
+// Add Map code from the address up to the next mapped address to the source position
+func (m *SourceMap) Add(addr int, line int, col int) {
+	e := sourceEntry{addr: addr, pos: SourcePos{Line: line, Col: col}}
+	n := len(m.entries)
+	if n > 0 && m.entries[n-1].addr == addr {
+		m.entries[n-1] = e
+		return
+	}
+	if n == 0 || m.entries[n-1].addr < addr {
+		m.entries = append(m.entries, e)
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return m.entries[i].addr >= addr })
+	if m.entries[i].addr == addr {
+		m.entries[i] = e
+		return
+	}
+	m.entries = append(m.entries, sourceEntry{})
+	copy(m.entries[i+1:], m.entries[i:])
+	m.entries[i] = e
+}
+
+// Lookup Source position of the code at the address
+func (m *SourceMap) Lookup(addr int) (SourcePos, bool) {
+	if m == nil {
+		return SourcePos{}, false
+	}
+	i := sort.Search(len(m.entries), func(i int) bool { return m.entries[i].addr > addr })
+	if i == 0 {
+		return SourcePos{}, false
+	}
+	return m.entries[i-1].pos, true
+}
+
+// Format Position of the code at the address as file:line:col, empty if it is unknown
+func (m *SourceMap) Format(addr int) string {
+	pos, ok := m.Lookup(addr)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d:%d", m.File, pos.Line, pos.Col)
+}
+
+// Len Number of mapped addresses
+func (m *SourceMap) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.entries)
+}
+
+// encode Serialize to the debug section: file name length and bytes, entries count, entries (address, line, column)
+func (m *SourceMap) encode() []byte {
+	if m == nil {
+		return nil
+	}
+	b := new(bytes.Buffer)
+	writeUint32(b, len(m.File))
+	b.WriteString(m.File)
+	writeUint32(b, len(m.entries))
+	for _, e := range m.entries {
+		writeUint32(b, e.addr)
+		writeUint32(b, e.pos.Line)
+		writeUint32(b, e.pos.Col)
+	}
+	return b.Bytes()
+}
+
+func decodeSourceMap(data []byte) (*SourceMap, error) {
+	r := &imageReader{data: data}
+	m := &SourceMap{File: string(r.bytes(r.uint32()))}
+	count := r.uint32()
+	for i := 0; i < count && r.err == nil; i++ {
+		addr, line, col := r.uint32(), r.uint32(), r.uint32()
+		m.Add(addr, line, col)
+	}
+	return m, r.err
+}
@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSourceMap_Format(t *testing.T) {
+	m := &SourceMap{File: "a.false"}
+	m.Add(5, 2, 1)
+	m.Add(0, 1, 1)
+	m.Add(2, 1, 3)
+	m.Add(2, 1, 4)
+	tests := []struct {
+		name string
+		m    *SourceMap
+		addr int
+		want string
+	}{
+		{
+			name: "check mapped address",
+			m:    m,
+			addr: 0,
+			want: "a.false:1:1",
+		},
+		{
+			name: "check address inside mapped range",
+			m:    m,
+			addr: 3,
+			want: "a.false:1:4",
+		},
+		{
+			name: "check address after the last entry",
+			m:    m,
+			addr: 100,
+			want: "a.false:2:1",
+		},
+		{
+			name: "check address before the first entry",
+			m:    &SourceMap{entries: []sourceEntry{{addr: 4, pos: SourcePos{Line: 1, Col: 1}}}},
+			addr: 3,
+			want: "",
+		},
+		{
+			name: "check nil map",
+			m:    nil,
+			addr: 0,
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.m.Format(tt.addr); got != tt.want {
+				t.Errorf("Format() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVM_FaultSource(t *testing.T) {
+	bc := NewBytecodeWriter()
+	bc.SetSourcePos(1, 1)
+	bc.WritePush(1)
+	bc.SetSourcePos(1, 3)
+	bc.WritePush(0)
+	bc.SetSourcePos(1, 5)
+	bc.WriteCommand(InstrDivide)
+	bc.WriteEnd()
+	img, err := bc.Image()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.SourceMap.File = "div.false"
+
+	vm := NewVM(64, 16, 16)
+	if err = vm.LoadImage(img); err != nil {
+		t.Fatal(err)
+	}
+	err = vm.Run()
+	var fault *VMFault
+	if !errors.As(err, &fault) {
+		t.Fatalf("Run() error = %v, want VMFault", err)
+	}
+	if fault.Source != "div.false:1:5" {
+		t.Errorf("Run() fault source = %q, want %q", fault.Source, "div.false:1:5")
+	}
+}
@@ -0,0 +1,177 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TraceFormat Format of the trace records
+type TraceFormat int
+
+const (
+	// TraceText Compact line per instruction: step, address, instruction, op stack before -> after
+	TraceText TraceFormat = iota
+	// TraceJSON JSON object per line
+	TraceJSON
+)
+
+var traceFormats = map[string]TraceFormat{
+	"text": TraceText,
+	"json": TraceJSON,
+}
+
+func (f TraceFormat) String() string {
+	for s, v := range traceFormats {
+		if v == f {
+			return s
+		}
+	}
+	return "unknown"
+}
+
+func ParseTraceFormat(s string) (TraceFormat, error) {
+	if f, ok := traceFormats[s]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("unknown trace format: %s", s)
+}
+
+// DefaultTraceDepth Number of op stack top items written by default
+const DefaultTraceDepth = 4
+
+// Tracer Writes executed instructions with the op stack top before and after them, set it to VM.Trace
+type Tracer struct {
+	Format TraceFormat
+	// Depth Number of op stack top items written, topmost first
+	Depth int
+	// From, To Traced address range, To is exclusive, the range is not limited if To is zero
+	From int
+	To   int
+	// Ops Traced instruction codes, all instructions are traced if it is empty
+	Ops map[int]bool
+
+	w *bufio.Writer
+	// step Number of executed instructions, filtered out ones are counted too, so steps of traces are comparable
+	step int64
+	err  error
+}
+
+// TraceRecord Executed instruction, Before and After are op stack top items, topmost first
+type TraceRecord struct {
+	Step   int64  `json:"step"`
+	IP     int    `json:"ip"`
+	Op     string `json:"op"`
+	Code   int    `json:"code"`
+	Args   []int  `json:"args"`
+	Before []int  `json:"before"`
+	After  []int  `json:"after"`
+	Pos    string `json:"pos,omitempty"`
+	Fault  string `json:"fault,omitempty"`
+}
+
+func NewTracer(w io.Writer, format TraceFormat) *Tracer {
+	return &Tracer{Format: format, Depth: DefaultTraceDepth, w: bufio.NewWriter(w)}
+}
+
+// ParseTraceOps Instruction codes by comma separated mnemonics (case-insensitive)
+func ParseTraceOps(s string) (map[int]bool, error) {
+	ops := make(map[int]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for i, info := range Instructions {
+			if strings.EqualFold(info.Name, name) {
+				ops[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown instruction: %s", name)
+		}
+	}
+	return ops, nil
+}
+
+// ParseTraceRange Address range "from-to" (to is exclusive), either bound may be omitted
+func ParseTraceRange(s string) (int, int, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid address range: %s", s)
+	}
+	var a, b int
+	var err error
+	if from != "" {
+		if a, err = strconv.Atoi(from); err != nil {
+			return 0, 0, fmt.Errorf("invalid address range: %s", s)
+		}
+	}
+	if to != "" {
+		if b, err = strconv.Atoi(to); err != nil || b <= a {
+			return 0, 0, fmt.Errorf("invalid address range: %s", s)
+		}
+	}
+	return a, b, nil
+}
+
+// match Check the instruction at the address passes the filters
+func (t *Tracer) match(vm *VM, ip int) bool {
+	if ip < t.From || (t.To > 0 && ip >= t.To) {
+		return false
+	}
+	if len(t.Ops) > 0 && (ip < 0 || ip >= len(vm.Memory) || !t.Ops[vm.Memory[ip]]) {
+		return false
+	}
+	return true
+}
+
+// record Write the record of the instruction executed at the address, write errors are kept for Flush
+func (t *Tracer) record(vm *VM, ip int, before []int, fault error) {
+	if t.err != nil {
+		return
+	}
+	r := TraceRecord{Step: t.step, IP: ip, Before: before, After: vm.OpStack.Top(t.Depth), Args: []int{}}
+	if ip >= 0 && ip < len(vm.Memory) {
+		in := DecodeInstruction(vm.Memory, ip)
+		r.Code = vm.Memory[ip]
+		r.Op = InstrName(r.Code)
+		if !in.Data && len(in.Args) > 0 {
+			r.Args = in.Args
+		}
+	}
+	r.Pos = vm.SourceMap.Format(ip)
+	if fault != nil {
+		r.Fault = fault.Error()
+	}
+	if t.Format == TraceJSON {
+		var b []byte
+		if b, t.err = json.Marshal(r); t.err == nil {
+			b = append(b, '\n')
+			_, t.err = t.w.Write(b)
+		}
+		return
+	}
+	line := fmt.Sprintf("%d %04d %s [%s] -> [%s]", r.Step, r.IP, strings.TrimSpace(r.Op+formatInts(r.Args, " ", " ")),
+		formatInts(r.Before, "", " "), formatInts(r.After, "", " "))
+	if r.Pos != "" {
+		line += " ; " + r.Pos
+	}
+	if r.Fault != "" {
+		line += " ! " + r.Fault
+	}
+	_, t.err = t.w.WriteString(line + "\n")
+}
+
+// Flush Write buffered records, the first write error is returned
+func (t *Tracer) Flush() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.w.Flush()
+}
@@ -0,0 +1,134 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// traceRun Run the code with the tracer set up by the function, returns the trace
+func traceRun(t *testing.T, write func(bc *BytecodeWriter), format TraceFormat, setup func(tr *Tracer)) string {
+	bc := NewBytecodeWriter()
+	write(bc)
+	bc.WriteEnd()
+	vm := NewVM(256, 32, 32)
+	vm.IO = NewStreamIO(strings.NewReader(""), new(bytes.Buffer))
+	if err := vm.Load(image(bc)); err != nil {
+		t.Fatal(err)
+	}
+	w := new(bytes.Buffer)
+	vm.Trace = NewTracer(w, format)
+	if setup != nil {
+		setup(vm.Trace)
+	}
+	_ = vm.Run()
+	if err := vm.Trace.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	return w.String()
+}
+
+func TestTracer_Text(t *testing.T) {
+	write := func(bc *BytecodeWriter) {
+		bc.WritePush(2)
+		bc.WritePush(3)
+		bc.WriteCommand(InstrPlus)
+		bc.WriteCommand(InstrDrop)
+		bc.WriteCommand(InstrDrop)
+	}
+	tests := []struct {
+		name  string
+		setup func(tr *Tracer)
+		want  string
+	}{
+		{
+			name: "check all instructions",
+			want: "1 0000 Push 2 [] -> [2]\n" +
+				"2 0002 Push 3 [2] -> [3 2]\n" +
+				"3 0004 Plus [3 2] -> [5]\n" +
+				"4 0005 Drop [5] -> []\n" +
+				"5 0006 Drop [] -> [] ! stack underflow at address 6: Drop, stack [], call depth 0\n",
+		},
+		{
+			name: "check stack depth",
+			setup: func(tr *Tracer) {
+				tr.Depth = 1
+				tr.Ops = map[int]bool{InstrPlus: true}
+			},
+			want: "3 0004 Plus [3] -> [5]\n",
+		},
+		{
+			name: "check address range",
+			setup: func(tr *Tracer) {
+				tr.From, tr.To = 2, 5
+			},
+			want: "2 0002 Push 3 [2] -> [3 2]\n" +
+				"3 0004 Plus [3 2] -> [5]\n",
+		},
+		{
+			name: "check negative stack depth",
+			setup: func(tr *Tracer) {
+				tr.Depth = -1
+				tr.Ops = map[int]bool{InstrPlus: true}
+			},
+			want: "3 0004 Plus [] -> []\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := traceRun(t, write, TraceText, tt.setup); got != tt.want {
+				t.Errorf("trace = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTracer_JSON(t *testing.T) {
+	got := traceRun(t, func(bc *BytecodeWriter) {
+		bc.WritePush(7)
+		bc.WriteCommand(InstrDup)
+	}, TraceJSON, nil)
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("trace has %d lines, want 3: %q", len(lines), got)
+	}
+	var r TraceRecord
+	if err := json.Unmarshal([]byte(lines[1]), &r); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if r.Step != 2 || r.IP != 2 || r.Op != "Dup" || r.Code != InstrDup || len(r.Args) != 0 ||
+		len(r.Before) != 1 || len(r.After) != 2 || r.After[0] != 7 {
+		t.Errorf("record = %+v", r)
+	}
+	if want := `{"step":1,"ip":0,"op":"Push","code":1,"args":[7],"before":[],"after":[7]}`; lines[0] != want {
+		t.Errorf("line = %s, want %s", lines[0], want)
+	}
+}
+
+func TestParseTraceRange(t *testing.T) {
+	tests := []struct {
+		s       string
+		from    int
+		to      int
+		wantErr bool
+	}{
+		{s: "10-40", from: 10, to: 40},
+		{s: "10-", from: 10},
+		{s: "-40", to: 40},
+		{s: "40-10", wantErr: true},
+		{s: "10", wantErr: true},
+	}
+	for _, tt := range tests {
+		from, to, err := ParseTraceRange(tt.s)
+		if (err != nil) != tt.wantErr || from != tt.from || to != tt.to {
+			t.Errorf("ParseTraceRange(%q) = %d, %d, %v", tt.s, from, to, err)
+		}
+	}
+	if ops, err := ParseTraceOps("call, Return"); err != nil || len(ops) != 2 || !ops[InstrCall] || !ops[InstrReturn] {
+		t.Errorf("ParseTraceOps() = %v, %v", ops, err)
+	}
+	if _, err := ParseTraceOps("jump"); err == nil {
+		t.Errorf("ParseTraceOps() of unknown instruction error = nil")
+	}
+}
@@ -1,15 +1,30 @@
 package vm
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"golang.org/x/term"
+	"io"
 	"log"
 	"os"
-	"strconv"
+	"time"
 )
 
+const (
+	defaultCheckInterval = 1024
+	faultStackDepth      = 8
+)
+
+// RunOptions Execution limits for RunContext
+type RunOptions struct {
+	// MaxInstructions Instructions budget ("fuel"), unlimited when zero
+	MaxInstructions int64
+	// Deadline Wall-clock deadline, none when zero
+	Deadline time.Time
+	// CheckInterval Number of instructions between cancellation and deadline checks
+	CheckInterval int
+}
+
 type VM struct {
 	Memory    []int
 	pmOffset  int
@@ -17,6 +32,20 @@ type VM struct {
 	ip        int
 	OpStack   *IntStack
 	CallStack *IntStack
+	IO        IO
+	SourceMap *SourceMap
+	Arith     ArithMode
+	DivZero   DivZeroMode
+	halted    bool
+	lastFault *VMFault
+
+	breakpoints map[int]bool
+	watchpoints map[int]bool
+	event       *Event
+	// Trace Tracer of executed instructions, tracing is off if it is nil
+	Trace *Tracer
+	// Profile Profiler of executed instructions, profiling is off if it is nil
+	Profile *Profiler
 }
 
 func NewVM(size int, opStackSize int, callStackSize int) *VM {
@@ -36,331 +65,490 @@ func (vm *VM) Load(img []int) error {
 	}
 	copy(vm.Memory, img)
 	vm.ip = 0
+	vm.halted = false
+	vm.event = nil
+	vm.lastFault = nil
 	vm.OpStack.Reset()
 	vm.CallStack.Reset()
 	return nil
 }
 
+// LoadImage Load image code and move instruction pointer to its entry point
+func (vm *VM) LoadImage(img *Image) error {
+	if err := vm.Load(img.Code); err != nil {
+		return err
+	}
+	vm.SourceMap = img.SourceMap
+	return vm.SetIP(img.Entry)
+}
+
 func (vm *VM) Run() error {
-	r := bufio.NewReader(os.Stdin)
-	w := bufio.NewWriter(os.Stdout)
+	return vm.RunContext(context.Background(), RunOptions{})
+}
 
-	defer func(w *bufio.Writer) {
-		_ = w.Flush()
-	}(w)
-	_, _ = w.WriteString("vm started\n\n")
-	w.Flush()
+// RunContext Run loaded image until the end instruction, a fault, context cancellation or budget exhaustion
+func (vm *VM) RunContext(ctx context.Context, opts RunOptions) error {
+	if vm.IO == nil {
+		vm.IO = NewStreamIO(os.Stdin, os.Stdout)
+	}
 
-	oldState, _ := term.MakeRaw(int(os.Stdin.Fd()))
-	defer term.Restore(int(os.Stdin.Fd()), oldState)
+	defer func(w IO) {
+		_ = w.Flush()
+	}(vm.IO)
 
-	for {
-		i, err := vm.next()
-		if err != nil {
-			return err
+	interval := int64(opts.CheckInterval)
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	vm.halted = false
+	var executed int64
+	for !vm.halted {
+		if opts.MaxInstructions > 0 && executed >= opts.MaxInstructions {
+			return &BudgetError{Budget: BudgetInstructions, IP: vm.ip, Executed: executed}
 		}
-		switch i {
-		case InstrPush:
-			v := 0
-			if v, err = vm.next(); err == nil {
-				if err = vm.OpStack.Push(v); err == nil {
-					break
-				}
+		if executed%interval == 0 {
+			if err := ctx.Err(); err != nil {
+				return &CancelError{IP: vm.ip, Executed: executed, Err: err}
 			}
-			return err
-		case InstrDup:
-			v := vm.OpStack.Peek()
-			err = vm.OpStack.Push(v)
-			if err != nil {
-				return err
-			}
-			break
-		case InstrDrop:
-			_, err = vm.OpStack.Pop()
-			if err != nil {
-				return err
-			}
-			break
-		case InstrSwap:
-			v1, v2, err := vm.OpStack.PopPop()
-			if err == nil {
-				if err = vm.OpStack.Push(v1); err == nil {
-					if err = vm.OpStack.Push(v2); err == nil {
-						break
-					}
-				}
+			if !opts.Deadline.IsZero() && time.Now().After(opts.Deadline) {
+				return &BudgetError{Budget: BudgetTime, IP: vm.ip, Executed: executed}
 			}
+		}
+		if err := vm.exec(); err != nil {
 			return err
-		case InstrRot:
-			if x2, err := vm.OpStack.Pop(); err == nil {
-				if x1, err := vm.OpStack.Pop(); err == nil {
-					if x, err := vm.OpStack.Pop(); err == nil {
-						if err = vm.OpStack.Push(x1); err == nil {
-							if err = vm.OpStack.Push(x2); err == nil {
-								if err = vm.OpStack.Push(x); err == nil {
-									break
-								}
-							}
-						}
-					}
-				}
+		}
+		executed++
+	}
+	return nil
+}
+
+// exec Execute single instruction at the instruction pointer
+func (vm *VM) exec() error {
+	ip, sp := vm.ip, vm.OpStack.p
+	var before []int
+	t := vm.Trace
+	if t != nil {
+		t.step++
+		if !t.match(vm, ip) {
+			t = nil
+		} else {
+			before = vm.OpStack.Top(t.Depth)
+		}
+	}
+	depth := 0
+	if vm.Profile != nil {
+		depth = vm.CallStack.Len()
+	}
+	i, err := vm.next()
+	if err == nil {
+		err = vm.execInstr(i)
+	}
+	if vm.Profile != nil {
+		vm.Profile.record(vm, ip, i, depth)
+	}
+	if err != nil {
+		// Restore stack pointer to snapshot the stack as it was before the instruction
+		vm.OpStack.p = sp
+		err = vm.fault(ip, i, err)
+	}
+	if t != nil {
+		t.record(vm, ip, before, err)
+	}
+	return err
+}
+
+func (vm *VM) execInstr(i int) error {
+	w := vm.IO
+	var err error
+	switch i {
+	case InstrPush:
+		v := 0
+		if v, err = vm.next(); err == nil {
+			if err = vm.OpStack.Push(v); err == nil {
+				break
 			}
-			return err
-		case InstrPick:
-			if v, err := vm.OpStack.Pop(); err == nil {
-				if v, err = vm.OpStack.Pick(v); err == nil {
-					if err = vm.OpStack.Push(v); err == nil {
-						return err
-					}
-				}
+		}
+		return err
+	case InstrDup:
+		v, err := vm.OpStack.Peek()
+		if err == nil {
+			if err = vm.OpStack.Push(v); err == nil {
+				break
 			}
+		}
+		return err
+	case InstrDrop:
+		_, err = vm.OpStack.Pop()
+		if err != nil {
 			return err
-		case InstrPlus:
-			v1, v2, err := vm.OpStack.PopPop()
-			if err == nil {
-				if err = vm.OpStack.Push(v1 + v2); err == nil {
+		}
+		break
+	case InstrSwap:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			if err = vm.OpStack.Push(v1); err == nil {
+				if err = vm.OpStack.Push(v2); err == nil {
 					break
 				}
 			}
-			return err
-		case InstrMinus:
-			v1, v2, err := vm.OpStack.PopPop()
-			if err == nil {
-				if err = vm.OpStack.Push(v2 - v1); err == nil {
-					break
+		}
+		return err
+	case InstrRot:
+		if x2, err := vm.OpStack.Pop(); err == nil {
+			if x1, err := vm.OpStack.Pop(); err == nil {
+				if x, err := vm.OpStack.Pop(); err == nil {
+					if err = vm.OpStack.Push(x1); err == nil {
+						if err = vm.OpStack.Push(x2); err == nil {
+							if err = vm.OpStack.Push(x); err == nil {
+								break
+							}
+						}
+					}
 				}
 			}
-			return err
-		case InstrMultiply:
-			v1, v2, err := vm.OpStack.PopPop()
-			if err == nil {
-				if err = vm.OpStack.Push(v1 * v2); err == nil {
-					break
+		}
+		return err
+	case InstrPick:
+		if v, err := vm.OpStack.Pop(); err == nil {
+			if v, err = vm.OpStack.Pick(v); err == nil {
+				if err = vm.OpStack.Push(v); err == nil {
+					return err
 				}
 			}
-			return err
-		case InstrDivide:
-			v1, v2, err := vm.OpStack.PopPop()
-			if err == nil {
-				if err = vm.OpStack.Push(v2 / v1); err == nil {
+		}
+		return err
+	case InstrPlus:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			var res int
+			if res, err = vm.plus(v2, v1); err == nil {
+				if err = vm.OpStack.Push(res); err == nil {
 					break
 				}
 			}
-			return err
-		case InstrNegative:
-			v, err := vm.OpStack.Pop()
-			if err == nil {
-				if err = vm.OpStack.Push(-v); err == nil {
+		}
+		return err
+	case InstrMinus:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			var res int
+			if res, err = vm.minus(v2, v1); err == nil {
+				if err = vm.OpStack.Push(res); err == nil {
 					break
 				}
 			}
-			return err
-		case InstrAnd:
-			v1, v2, err := vm.OpStack.PopPop()
-			if err == nil {
-				res := 0
-				if v1 != 0 && v2 != 0 {
-					res = 1
-				}
+		}
+		return err
+	case InstrMultiply:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			var res int
+			if res, err = vm.multiply(v2, v1); err == nil {
 				if err = vm.OpStack.Push(res); err == nil {
 					break
 				}
 			}
-			return err
-		case InstrOr:
-			v1, v2, err := vm.OpStack.PopPop()
-			if err == nil {
-				res := 0
-				if v1 != 0 || v2 != 0 {
-					res = 1
-				}
+		}
+		return err
+	case InstrDivide:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			var res int
+			if res, err = vm.divide(v2, v1); err == nil {
 				if err = vm.OpStack.Push(res); err == nil {
 					break
 				}
 			}
-			return err
-		case InstrNot:
-			v1, err := vm.OpStack.Pop()
-			if err == nil {
-				res := 0
-				if v1 == 0 {
-					res = 1
-				}
+		}
+		return err
+	case InstrMod:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			var res int
+			if res, err = vm.mod(v2, v1); err == nil {
 				if err = vm.OpStack.Push(res); err == nil {
 					break
 				}
 			}
-			return err
-		case InstrEquals:
-			v1, v2, err := vm.OpStack.PopPop()
-			if err == nil {
-				eq := 0
-				if v1 == v2 {
-					eq = 1
-				}
-				if err = vm.OpStack.Push(eq); err == nil {
+		}
+		return err
+	case InstrNegative:
+		v, err := vm.OpStack.Pop()
+		if err == nil {
+			if v, err = vm.negative(v); err == nil {
+				if err = vm.OpStack.Push(v); err == nil {
 					break
 				}
 			}
-			return err
-		case InstrMore:
-			v1, v2, err := vm.OpStack.PopPop()
-			if err == nil {
-				eq := 0
-				if v2 > v1 {
-					eq = 1
-				}
-				if err = vm.OpStack.Push(eq); err == nil {
-					break
-				}
+		}
+		return err
+	case InstrAnd:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			res := 0
+			if v1 != 0 && v2 != 0 {
+				res = 1
 			}
-			return err
-		case InstrWriteInt:
-			v, err := vm.OpStack.Pop()
-			if err != nil {
-				return err
+			if err = vm.OpStack.Push(res); err == nil {
+				break
 			}
-			_, _ = w.WriteString(strconv.Itoa(v))
-			break
-		case InstrWriteChar:
-			v, err := vm.OpStack.Pop()
-			if err != nil {
-				return err
+		}
+		return err
+	case InstrOr:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			res := 0
+			if v1 != 0 || v2 != 0 {
+				res = 1
 			}
-			writeChar(v, w)
-			break
-		case InstrWriteStr:
-			l, err := vm.next()
-			if err != nil {
-				return err
+			if err = vm.OpStack.Push(res); err == nil {
+				break
 			}
-			for i := 0; i < l; i++ {
-				v, err := vm.next()
-				if err != nil {
-					return err
-				}
-				writeChar(v, w)
+		}
+		return err
+	case InstrNot:
+		v1, err := vm.OpStack.Pop()
+		if err == nil {
+			res := 0
+			if v1 == 0 {
+				res = 1
 			}
-			break
-		case InstrReadChar:
-			r, _, _ := r.ReadRune()
-			err = vm.OpStack.Push(int(r))
-			if err != nil {
-				return err
+			if err = vm.OpStack.Push(res); err == nil {
+				break
 			}
-			break
-		case InstrFlush:
-			_ = w.Flush()
-			break
-		case InstrStore:
-			var addr, val int
-			if addr, err = vm.next(); err == nil {
-				if addr >= vm.pmOffset && addr < vm.pmSize {
-					if val, err = vm.OpStack.Pop(); err == nil {
-						vm.Memory[addr] = val
-						break
-					}
-				} else {
-					err = errors.New("out of memory")
-				}
+		}
+		return err
+	case InstrBitAnd:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			if err = vm.OpStack.Push(v2 & v1); err == nil {
+				break
 			}
-			return err
-		case InstrFetch:
-			var addr int
-			if addr, err = vm.next(); err == nil {
-				if addr >= vm.pmOffset && addr < vm.pmSize {
-					val := vm.Memory[addr]
-					if err = vm.OpStack.Push(val); err == nil {
-						break
-					}
-				} else {
-					err = errors.New("out of memory")
-				}
+		}
+		return err
+	case InstrBitOr:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			if err = vm.OpStack.Push(v2 | v1); err == nil {
+				break
 			}
-			return err
-		case InstrCopy:
-			var addr1, addr2 int
-			if addr1, err = vm.next(); err == nil {
-				if addr2, err = vm.next(); err == nil {
-					if addr1 >= vm.pmOffset && addr1 < vm.pmSize &&
-						addr2 >= vm.pmOffset && addr2 < vm.pmSize {
-						vm.Memory[addr2] = vm.Memory[addr1]
-						break
-					} else {
-						err = errors.New("out of memory")
-					}
-				}
+		}
+		return err
+	case InstrBitNot:
+		v1, err := vm.OpStack.Pop()
+		if err == nil {
+			if err = vm.OpStack.Push(^v1); err == nil {
+				break
+			}
+		}
+		return err
+	case InstrEquals:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			eq := 0
+			if v1 == v2 {
+				eq = 1
+			}
+			if err = vm.OpStack.Push(eq); err == nil {
+				break
+			}
+		}
+		return err
+	case InstrMore:
+		v1, v2, err := vm.OpStack.PopPop()
+		if err == nil {
+			eq := 0
+			if v2 > v1 {
+				eq = 1
+			}
+			if err = vm.OpStack.Push(eq); err == nil {
+				break
 			}
+		}
+		return err
+	case InstrWriteInt:
+		v, err := vm.OpStack.Pop()
+		if err != nil {
+			return err
+		}
+		if err = w.WriteInt(v); err != nil {
+			return err
+		}
+		break
+	case InstrWriteChar:
+		v, err := vm.OpStack.Pop()
+		if err != nil {
 			return err
-		case InstrCall:
-			addr, err := vm.OpStack.Pop()
+		}
+		if err = w.WriteChar(v); err != nil {
+			return err
+		}
+		break
+	case InstrWriteStr:
+		l, err := vm.next()
+		if err != nil {
+			return err
+		}
+		// Length comes from the bytecode, so the chars must be in memory before anything is allocated
+		if l < 0 || vm.ip+l > len(vm.Memory) {
+			return ErrOutOfBounds
+		}
+		s := make([]rune, l)
+		for i := 0; i < l; i++ {
+			v, err := vm.next()
 			if err != nil {
 				return err
 			}
-			err = vm.CallStack.Push(vm.ip)
-			if err != nil {
-				return err
+			s[i] = rune(v)
+		}
+		if err = w.WriteStr(string(s)); err != nil {
+			return err
+		}
+		break
+	case InstrReadChar:
+		c, err := w.ReadChar()
+		if err == io.EOF {
+			c = -1
+		} else if err != nil {
+			return err
+		}
+		err = vm.OpStack.Push(c)
+		if err != nil {
+			return err
+		}
+		break
+	case InstrFlush:
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		break
+	case InstrStore:
+		var addr, val int
+		if addr, err = vm.next(); err == nil {
+			if addr >= vm.pmOffset && addr < vm.pmSize {
+				if val, err = vm.OpStack.Pop(); err == nil {
+					vm.store(addr, val)
+					break
+				}
+			} else {
+				err = ErrOutOfBounds
 			}
-			vm.ip = addr
-			break
-		case InstrCallIf:
-			addr, err := vm.OpStack.Pop()
-			if err != nil {
-				return err
+		}
+		return err
+	case InstrFetch:
+		var addr int
+		if addr, err = vm.next(); err == nil {
+			if addr >= vm.pmOffset && addr < vm.pmSize {
+				val := vm.Memory[addr]
+				if err = vm.OpStack.Push(val); err == nil {
+					break
+				}
+			} else {
+				err = ErrOutOfBounds
 			}
-			cond, err := vm.OpStack.Pop()
-			if err != nil {
-				return err
+		}
+		return err
+	case InstrCopy:
+		var addr1, addr2 int
+		if addr1, err = vm.next(); err == nil {
+			if addr2, err = vm.next(); err == nil {
+				if addr1 >= vm.pmOffset && addr1 < vm.pmSize &&
+					addr2 >= vm.pmOffset && addr2 < vm.pmSize {
+					vm.store(addr2, vm.Memory[addr1])
+					break
+				} else {
+					err = ErrOutOfBounds
+				}
 			}
-			if cond != 0 {
-				err = vm.CallStack.Push(vm.ip)
-				if err != nil {
-					return err
+		}
+		return err
+	case InstrStoreI:
+		var addr, val int
+		if addr, err = vm.OpStack.Pop(); err == nil {
+			if addr >= vm.pmOffset && addr < vm.pmSize {
+				if val, err = vm.OpStack.Pop(); err == nil {
+					vm.store(addr, val)
+					break
 				}
-				vm.ip = addr
+			} else {
+				err = ErrOutOfBounds
 			}
-			break
-		case InstrReturn:
-			addr, err := vm.CallStack.Pop()
-			if err != nil {
-				return err
+		}
+		return err
+	case InstrFetchI:
+		var addr int
+		if addr, err = vm.OpStack.Pop(); err == nil {
+			if addr >= vm.pmOffset && addr < vm.pmSize {
+				if err = vm.OpStack.Push(vm.Memory[addr]); err == nil {
+					break
+				}
+			} else {
+				err = ErrOutOfBounds
 			}
-			vm.ip = addr
-			break
-		case InstrGoto:
-			addr, err := vm.next()
+		}
+		return err
+	case InstrCall:
+		addr, err := vm.OpStack.Pop()
+		if err != nil {
+			return err
+		}
+		err = vm.CallStack.Push(vm.ip)
+		if err != nil {
+			return err
+		}
+		vm.ip = addr
+		break
+	case InstrCallIf:
+		addr, err := vm.OpStack.Pop()
+		if err != nil {
+			return err
+		}
+		cond, err := vm.OpStack.Pop()
+		if err != nil {
+			return err
+		}
+		if cond != 0 {
+			err = vm.CallStack.Push(vm.ip)
 			if err != nil {
 				return err
 			}
 			vm.ip = addr
-			break
-		case InstrGotoIf:
-			addr := 0
-			if addr, err = vm.OpStack.Pop(); err != nil {
-				return err
-			}
-			cond := 0
-			if cond, err = vm.OpStack.Pop(); err != nil {
-				return err
-			}
-			if cond != 0 {
-				vm.ip = addr
-			}
-			break
-		case InstrEnd:
-			_, _ = w.WriteString("\n\nvm gracefully stopped\n")
-			return nil
-		default:
-			return errors.New("invalid instruction " + strconv.Itoa(i))
 		}
+		break
+	case InstrReturn:
+		addr, err := vm.CallStack.Pop()
+		if err != nil {
+			return err
+		}
+		vm.ip = addr
+		break
+	case InstrGoto:
+		addr, err := vm.next()
+		if err != nil {
+			return err
+		}
+		vm.ip = addr
+		break
+	case InstrGotoIf:
+		addr := 0
+		if addr, err = vm.OpStack.Pop(); err != nil {
+			return err
+		}
+		cond := 0
+		if cond, err = vm.OpStack.Pop(); err != nil {
+			return err
+		}
+		if cond != 0 {
+			vm.ip = addr
+		}
+		break
+	case InstrEnd:
+		vm.halted = true
+		break
+	default:
+		return ErrInvalidInstruction
 	}
-}
-
-func writeChar(v int, w *bufio.Writer) {
-	if v == '\n' {
-		_, _ = w.WriteRune('\r')
-	}
-	_, _ = w.WriteRune(rune(v))
+	return nil
 }
 
 func (s *IntStack) PopPop() (int, int, error) {
@@ -376,15 +564,43 @@ func (s *IntStack) PopPop() (int, int, error) {
 }
 
 func (vm *VM) next() (int, error) {
-	if vm.ip >= len(vm.Memory) {
-		return 0, errors.New("out of memory")
+	if vm.ip < 0 || vm.ip >= len(vm.Memory) {
+		return OpFetch, ErrOutOfBounds
 	}
 	i := vm.Memory[vm.ip]
 	vm.ip++
 	return i, nil
 }
 
+// fault Wrap error of the instruction i at address ip to VMFault
+func (vm *VM) fault(ip int, i int, err error) error {
+	var f *VMFault
+	if errors.As(err, &f) {
+		return err
+	}
+	f = &VMFault{
+		Kind:      err,
+		IP:        ip,
+		Op:        i,
+		OpName:    InstrName(i),
+		Stack:     vm.OpStack.Top(faultStackDepth),
+		CallDepth: vm.CallStack.Len(),
+		Source:    vm.SourceMap.Format(ip),
+	}
+	if info, ok := Instructions[i]; ok {
+		for a := 1; a <= info.Args && ip >= 0 && ip+a < len(vm.Memory); a++ {
+			f.Operands = append(f.Operands, vm.Memory[ip+a])
+		}
+	}
+	vm.lastFault = f
+	return f
+}
+
 func (vm *VM) Fault() {
+	if vm.lastFault != nil {
+		log.Printf("fault: %s\n", vm.lastFault.Error())
+		return
+	}
 	log.Printf("fault on address %d\n", vm.ip)
 }
 
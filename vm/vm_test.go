@@ -0,0 +1,401 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func image(bc *BytecodeWriter) []int {
+	b := bc.Bytes()
+	img := make([]int, len(b)/4)
+	for i := range img {
+		img[i] = int(int32(binary.LittleEndian.Uint32(b[i*4:])))
+	}
+	return img
+}
+
+func TestVM_Run(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(bc *BytecodeWriter)
+		in    string
+		want  string
+	}{
+		{
+			name: "check write int",
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(2)
+				bc.WritePush(2)
+				bc.WriteCommand(InstrPlus)
+				bc.WriteCommand(InstrWriteInt)
+			},
+			want: "4",
+		},
+		{
+			name: "check write string",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteString("hello\n")
+			},
+			want: "hello\n",
+		},
+		{
+			name: "check read and write char",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteCommand(InstrReadChar)
+				bc.WriteCommand(InstrReadChar)
+				bc.WriteCommand(InstrSwap)
+				bc.WriteCommand(InstrWriteChar)
+				bc.WriteCommand(InstrWriteChar)
+			},
+			in:   "ab",
+			want: "ab",
+		},
+		{
+			name: "check read char on end of input",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteCommand(InstrReadChar)
+				bc.WriteCommand(InstrWriteInt)
+			},
+			want: "-1",
+		},
+		{
+			name: "check indirect store and fetch",
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(42)
+				bc.WritePush(500)
+				bc.WriteCommand(InstrStoreI)
+				bc.WritePush(500)
+				bc.WriteCommand(InstrFetchI)
+				bc.WriteCommand(InstrWriteInt)
+			},
+			want: "42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := NewBytecodeWriter()
+			tt.write(bc)
+			bc.WriteEnd()
+
+			out := new(bytes.Buffer)
+			v := NewVM(1024, 64, 64)
+			v.IO = NewStreamIO(strings.NewReader(tt.in), out)
+			if err := v.Load(image(bc)); err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if err := v.Run(); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("Run() output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVM_RunContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		opts    RunOptions
+		wantErr func(err error) bool
+	}{
+		{
+			name: "check instructions budget",
+			ctx:  context.Background(),
+			opts: RunOptions{MaxInstructions: 100},
+			wantErr: func(err error) bool {
+				var be *BudgetError
+				return errors.As(err, &be) && be.Budget == BudgetInstructions && be.Executed == 100
+			},
+		},
+		{
+			name: "check deadline",
+			ctx:  context.Background(),
+			opts: RunOptions{Deadline: time.Now().Add(10 * time.Millisecond)},
+			wantErr: func(err error) bool {
+				var be *BudgetError
+				return errors.As(err, &be) && be.Budget == BudgetTime
+			},
+		},
+		{
+			name: "check cancellation",
+			ctx:  cancelled,
+			opts: RunOptions{},
+			wantErr: func(err error) bool {
+				var ce *CancelError
+				return errors.As(err, &ce) && errors.Is(err, context.Canceled)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := NewBytecodeWriter()
+			bc.WriteGoto(0)
+
+			v := NewVM(1024, 64, 64)
+			v.IO = NewStreamIO(strings.NewReader(""), new(bytes.Buffer))
+			if err := v.Load(image(bc)); err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if err := v.RunContext(tt.ctx, tt.opts); !tt.wantErr(err) {
+				t.Errorf("RunContext() unexpected error = %v", err)
+			}
+		})
+	}
+}
+
+func TestVM_Fault(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(bc *BytecodeWriter)
+		wantKind error
+		wantIP   int
+		wantOp   int
+	}{
+		{
+			name: "check stack underflow",
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(1)
+				bc.WriteCommand(InstrPlus)
+			},
+			wantKind: ErrStackUnderflow,
+			wantIP:   2,
+			wantOp:   InstrPlus,
+		},
+		{
+			name: "check dup on empty stack",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteCommand(InstrDup)
+			},
+			wantKind: ErrStackUnderflow,
+			wantIP:   0,
+			wantOp:   InstrDup,
+		},
+		{
+			name: "check stack overflow",
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(1)
+				bc.WriteGoto(0)
+			},
+			wantKind: ErrStackOverflow,
+			wantIP:   0,
+			wantOp:   InstrPush,
+		},
+		{
+			name: "check out of bounds",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteFetch(100000)
+			},
+			wantKind: ErrOutOfBounds,
+			wantIP:   0,
+			wantOp:   InstrFetch,
+		},
+		{
+			name: "check indirect out of bounds",
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(1)
+				bc.WritePush(-1)
+				bc.WriteCommand(InstrStoreI)
+			},
+			wantKind: ErrOutOfBounds,
+			wantIP:   4,
+			wantOp:   InstrStoreI,
+		},
+		{
+			name: "check negative string length",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteCommand(InstrWriteStr)
+				bc.WriteInt(-1)
+			},
+			wantKind: ErrOutOfBounds,
+			wantIP:   0,
+			wantOp:   InstrWriteStr,
+		},
+		{
+			name: "check string length out of memory",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteCommand(InstrWriteStr)
+				bc.WriteInt(1 << 30)
+			},
+			wantKind: ErrOutOfBounds,
+			wantIP:   0,
+			wantOp:   InstrWriteStr,
+		},
+		{
+			name: "check call to negative address",
+			write: func(bc *BytecodeWriter) {
+				bc.WritePush(-5)
+				bc.WriteCall()
+			},
+			wantKind: ErrOutOfBounds,
+			wantIP:   -5,
+			wantOp:   OpFetch,
+		},
+		{
+			name: "check goto to negative address",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteGoto(-1)
+			},
+			wantKind: ErrOutOfBounds,
+			wantIP:   -1,
+			wantOp:   OpFetch,
+		},
+		{
+			name: "check goto past memory",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteGoto(100000)
+			},
+			wantKind: ErrOutOfBounds,
+			wantIP:   100000,
+			wantOp:   OpFetch,
+		},
+		{
+			name: "check invalid instruction",
+			write: func(bc *BytecodeWriter) {
+				bc.WriteCommand(999)
+			},
+			wantKind: ErrInvalidInstruction,
+			wantIP:   0,
+			wantOp:   999,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := NewBytecodeWriter()
+			tt.write(bc)
+			bc.WriteEnd()
+
+			v := NewVM(1024, 64, 64)
+			v.IO = NewStreamIO(strings.NewReader(""), new(bytes.Buffer))
+			if err := v.Load(image(bc)); err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			err := v.Run()
+			var f *VMFault
+			if !errors.As(err, &f) {
+				t.Fatalf("Run() error = %v, want VMFault", err)
+			}
+			if !errors.Is(err, tt.wantKind) {
+				t.Errorf("Run() fault kind = %v, want %v", f.Kind, tt.wantKind)
+			}
+			if f.IP != tt.wantIP || f.Op != tt.wantOp || f.OpName != InstrName(tt.wantOp) {
+				t.Errorf("Run() fault at %d op %d %s, want at %d op %d", f.IP, f.Op, f.OpName, tt.wantIP, tt.wantOp)
+			}
+			if tt.wantOp == OpFetch && !strings.Contains(err.Error(), "at address "+strconv.Itoa(tt.wantIP)+": <fetch>,") {
+				t.Errorf("Run() error = %q, want <fetch> op", err.Error())
+			}
+		})
+	}
+}
+
+func TestVM_Arith(t *testing.T) {
+	tests := []struct {
+		name    string
+		arith   ArithMode
+		divZero DivZeroMode
+		a, b    int
+		op      int
+		want    int
+		wantErr error
+	}{
+		{name: "check wrap plus", arith: ArithWrap, a: math.MaxInt32, b: 1, op: InstrPlus, want: math.MinInt32},
+		{name: "check wrap multiply", arith: ArithWrap, a: 65536, b: 65536, op: InstrMultiply, want: 0},
+		{name: "check saturate plus", arith: ArithSaturate, a: math.MaxInt32, b: 1, op: InstrPlus, want: math.MaxInt32},
+		{name: "check saturate minus", arith: ArithSaturate, a: math.MinInt32, b: 1, op: InstrMinus, want: math.MinInt32},
+		{name: "check trap multiply", arith: ArithTrap, a: 65536, b: 65536, op: InstrMultiply, wantErr: ErrOverflow},
+		{name: "check trap divide", arith: ArithTrap, a: math.MinInt32, b: -1, op: InstrDivide, wantErr: ErrOverflow},
+		{name: "check trap negative", arith: ArithTrap, b: math.MinInt32, op: InstrNegative, wantErr: ErrOverflow},
+		{name: "check divide by zero fault", a: 1, b: 0, op: InstrDivide, wantErr: ErrDivideByZero},
+		{name: "check divide by zero yield", divZero: DivZeroYield, a: 1, b: 0, op: InstrDivide, want: 0},
+		{name: "check divide truncation", a: -7, b: 2, op: InstrDivide, want: -3},
+		{name: "check mod floored", a: -7, b: 3, op: InstrMod, want: 2},
+		{name: "check mod negative divisor", a: 7, b: -3, op: InstrMod, want: -2},
+		{name: "check bitwise and", a: 12, b: 10, op: InstrBitAnd, want: 8},
+		{name: "check bitwise or", a: 12, b: 10, op: InstrBitOr, want: 14},
+		{name: "check mod by zero fault", a: 1, b: 0, op: InstrMod, wantErr: ErrDivideByZero},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := NewBytecodeWriter()
+			bc.WritePush(tt.a)
+			bc.WritePush(tt.b)
+			bc.WriteCommand(tt.op)
+			bc.WriteCommand(InstrWriteInt)
+			bc.WriteEnd()
+
+			out := new(bytes.Buffer)
+			v := NewVM(1024, 64, 64)
+			v.IO = NewStreamIO(strings.NewReader(""), out)
+			v.Arith = tt.arith
+			v.DivZero = tt.divZero
+			if err := v.Load(image(bc)); err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			err := v.Run()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Run() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got := out.String(); got != strconv.Itoa(tt.want) {
+				t.Errorf("Run() output = %s, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVM_Debug(t *testing.T) {
+	bc := NewBytecodeWriter()
+	addr := bc.WriteVar(0)
+	bc.WritePush(7)
+	store := bc.Len()
+	bc.WriteStore(addr)
+	bc.WriteEnd()
+
+	v := NewVM(1024, 64, 64)
+	v.IO = NewStreamIO(strings.NewReader(""), new(bytes.Buffer))
+	if err := v.Load(image(bc)); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	v.SetBreakpoint(3)
+	v.Watch(addr)
+
+	e, err := v.Continue(context.Background())
+	if err != nil || e == nil || e.Kind != EventBreakpoint || e.IP != 3 {
+		t.Fatalf("Continue() = %+v, %v, want breakpoint at 3", e, err)
+	}
+	e, err = v.Continue(context.Background())
+	if err != nil || e == nil || e.Kind != EventWatchpoint || e.IP != store || e.Addr != addr || e.Old != 0 || e.New != 7 {
+		t.Fatalf("Continue() = %+v, %v, want watchpoint on %d at %d", e, err, addr, store)
+	}
+	e, err = v.Step()
+	if err != nil || e == nil || e.Kind != EventHalt {
+		t.Fatalf("Step() = %+v, %v, want halt", e, err)
+	}
+	if _, err = v.Step(); !errors.Is(err, ErrHalted) {
+		t.Errorf("Step() error = %v, want %v", err, ErrHalted)
+	}
+
+	// Loading the image again runs it from the start
+	if err = v.Load(image(bc)); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	e, err = v.Continue(context.Background())
+	if err != nil || e == nil || e.Kind != EventBreakpoint || e.IP != 3 {
+		t.Fatalf("Continue() after Load() = %+v, %v, want breakpoint at 3", e, err)
+	}
+}